@@ -1,6 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -10,25 +18,642 @@ import (
 
 // go test -v homework_test.go
 
+var (
+	ErrPoolFull    = errors.New("worker pool is full")
+	ErrPoolClosed  = errors.New("worker pool is closed")
+	ErrTaskDropped = errors.New("task dropped by overflow policy")
+)
+
+// PanicError is what a panicking task turns into instead of crashing the process
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("task panicked: %v\n%s", e.Value, e.Stack)
+}
+
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// AbandonedTasksError is returned by Shutdown when some
+// accepted tasks were never started
+type AbandonedTasksError struct {
+	Dropped   int // evicted by the DropOldestPolicy
+	Cancelled int // cancelled through their future while still queued
+}
+
+func (e *AbandonedTasksError) Error() string {
+	return fmt.Sprintf("%d task(s) abandoned: %d dropped, %d cancelled", e.Dropped+e.Cancelled, e.Dropped, e.Cancelled)
+}
+
+// OverflowPolicy defines what AddTask does when the backlog is full
+type OverflowPolicy int
+
+const (
+	RejectPolicy     OverflowPolicy = iota // return ErrPoolFull
+	BlockPolicy                            // wait until the backlog has room
+	DropOldestPolicy                       // evict the oldest queued task to make room
+	CallerRunsPolicy                       // execute the task in the caller's goroutine
+)
+
+const defaultBacklog = 64
+
+type PoolOption func(*WorkerPool)
+
+// WithBacklog sets how many tasks may wait for a free worker
+func WithBacklog(capacity int) PoolOption {
+	return func(wp *WorkerPool) {
+		wp.capacity = capacity
+	}
+}
+
+func WithOverflowPolicy(policy OverflowPolicy) PoolOption {
+	return func(wp *WorkerPool) {
+		wp.policy = policy
+	}
+}
+
+// WithPanicHandler receives panics of tasks added with AddTask, by default
+// they are logged, panics of submitted tasks are reported through their futures
+func WithPanicHandler(handler func(err *PanicError)) PoolOption {
+	return func(wp *WorkerPool) {
+		if handler != nil {
+			wp.onPanic = handler
+		}
+	}
+}
+
+// WithScaleUpThresholds makes an elastic pool start a new worker once at least
+// backlog tasks are waiting or a task has waited longer than wait (0 disables the check)
+func WithScaleUpThresholds(backlog int, wait time.Duration) PoolOption {
+	return func(wp *WorkerPool) {
+		wp.scaleUpBacklog = backlog
+		wp.scaleUpWait = wait
+	}
+}
+
+type job struct {
+	run      func()
+	queuedAt time.Time
+	detached func()          // run without the link to the interruption of the pool, may be nil
+	claim    func() bool     // reports false if the task was cancelled before a worker took it, may be nil
+	abandon  func(err error) // resolves whoever waits for a claimed task that will never run, may be nil
+}
+
+// ShutdownReport describes what happened to the tasks accepted by the pool
+type ShutdownReport struct {
+	Completed int // run by a worker, including the interrupted and panicked ones
+	Cancelled int // cancelled through their future while still queued
+	Dropped   int // evicted by the overflow policy or left unstarted by the shutdown
+}
+
 type WorkerPool struct {
-	// need to implement
+	tasks    chan job
+	capacity int
+	policy   OverflowPolicy
+
+	onPanic        func(err *PanicError)
+	scaleUpBacklog int
+	scaleUpWait    time.Duration
+	idleTimeout    time.Duration // 0 means idle workers are never retired
+
+	mutex      sync.Mutex
+	minWorkers int
+	maxWorkers int
+	running    int
+	resized    chan struct{} // closed and replaced when the pool shrinks to wake idle workers
+	closed     bool
+	closing    chan struct{} // closed on shutdown to release blocked producers
+	closeOnce  sync.Once
+	senders    sync.WaitGroup
+	workers    sync.WaitGroup
+	leftovers  []job         // tasks taken by workers after the pool was interrupted
+	taken      atomic.Uint64 // tasks taken out of the backlog, tells the wait monitor that the queue moves
+
+	ctx       context.Context // parent of the contexts of submitted tasks
+	interrupt context.CancelFunc
+
+	completed atomic.Int64
+	dropped   atomic.Int64
+	cancelled atomic.Int64
+}
+
+func NewWorkerPool(workersNumber int, options ...PoolOption) *WorkerPool {
+	return newWorkerPool(workersNumber, workersNumber, 0, options...)
 }
 
-func NewWorkerPool(workersNumber int) *WorkerPool {
-	// need to implement
-	return &WorkerPool{}
+// NewElasticWorkerPool keeps between minWorkers and maxWorkers workers,
+// it grows while tasks pile up and retires workers idle for idleTimeout
+func NewElasticWorkerPool(minWorkers, maxWorkers int, idleTimeout time.Duration, options ...PoolOption) *WorkerPool {
+	return newWorkerPool(minWorkers, maxWorkers, idleTimeout, options...)
+}
+
+func newWorkerPool(minWorkers, maxWorkers int, idleTimeout time.Duration, options ...PoolOption) *WorkerPool {
+	if minWorkers < 0 || maxWorkers < 1 || minWorkers > maxWorkers {
+		panic("worker pool bounds must satisfy 0 <= min <= max and max > 0")
+	}
+
+	wp := &WorkerPool{
+		capacity:       defaultBacklog,
+		policy:         RejectPolicy,
+		onPanic:        logPanic,
+		scaleUpBacklog: 1,
+		idleTimeout:    idleTimeout,
+		minWorkers:     minWorkers,
+		maxWorkers:     maxWorkers,
+		resized:        make(chan struct{}),
+		closing:        make(chan struct{}),
+	}
+	wp.ctx, wp.interrupt = context.WithCancel(context.Background())
+	for idx := range options {
+		options[idx](wp)
+	}
+
+	if wp.capacity < 1 {
+		panic("worker pool backlog capacity must be positive")
+	}
+
+	wp.tasks = make(chan job, wp.capacity)
+
+	wp.mutex.Lock()
+	for i := 0; i < minWorkers; i++ {
+		wp.spawnLocked()
+	}
+	wp.mutex.Unlock()
+
+	if wp.scaleUpWait > 0 {
+		go wp.monitorWaits()
+	}
+	return wp
+}
+
+// Workers returns the number of currently running workers
+func (wp *WorkerPool) Workers() int {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+	return wp.running
+}
+
+// Resize sets the worker count to n, for an elastic pool n becomes
+// the new maximum and the minimum is lowered to n if necessary
+func (wp *WorkerPool) Resize(n int) {
+	if n < 1 {
+		panic("worker pool size must be positive")
+	}
+
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+
+	if wp.minWorkers == wp.maxWorkers {
+		wp.minWorkers = n
+	}
+	wp.minWorkers = min(wp.minWorkers, n)
+	wp.maxWorkers = n
+
+	if wp.closed {
+		return
+	}
+
+	for wp.running < wp.minWorkers {
+		wp.spawnLocked()
+	}
+	if wp.running > wp.maxWorkers {
+		close(wp.resized)
+		wp.resized = make(chan struct{})
+	}
+}
+
+func logPanic(err *PanicError) {
+	log.Printf("worker pool: %v", err)
+}
+
+func (wp *WorkerPool) spawnLocked() {
+	wp.running++
+	wp.workers.Add(1)
+	go wp.work()
+}
+
+// grow starts one more worker if the pool is allowed to
+func (wp *WorkerPool) grow() {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+
+	if !wp.closed && wp.running < wp.maxWorkers {
+		wp.spawnLocked()
+	}
+}
+
+// retire reports whether the calling worker has to exit, idle workers
+// may leave down to the minimum and any worker may leave above the maximum,
+// the returned channel is closed as soon as the maximum gets lowered.
+// The last worker stays while tasks are queued: submit may have seen it
+// running and decided not to grow
+func (wp *WorkerPool) retire(idle bool) (bool, <-chan struct{}) {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+
+	lastWithBacklog := wp.running == 1 && len(wp.tasks) > 0
+	if wp.running > wp.maxWorkers || (idle && wp.running > wp.minWorkers && !lastWithBacklog) {
+		wp.running--
+		return true, nil
+	}
+	return false, wp.resized
+}
+
+func (wp *WorkerPool) work() {
+	defer wp.workers.Done()
+
+	var idle *time.Timer
+	var timeout <-chan time.Time
+	if wp.idleTimeout > 0 {
+		idle = time.NewTimer(wp.idleTimeout)
+		defer idle.Stop()
+		timeout = idle.C
+	}
+
+	retired, resized := wp.retire(false)
+	for !retired {
+		select {
+		case task, opened := <-wp.tasks:
+			if !opened {
+				wp.mutex.Lock()
+				wp.running--
+				wp.mutex.Unlock()
+				return
+			}
+
+			wp.taken.Add(1)
+			if wp.ctx.Err() != nil {
+				wp.mutex.Lock()
+				wp.leftovers = append(wp.leftovers, task)
+				wp.mutex.Unlock()
+				continue
+			}
+
+			if wp.scaleUpWait > 0 && time.Since(task.queuedAt) > wp.scaleUpWait {
+				wp.grow()
+			}
+			wp.execute(task)
+
+			if idle != nil {
+				if !idle.Stop() {
+					select {
+					case <-idle.C:
+					default:
+					}
+				}
+				idle.Reset(wp.idleTimeout)
+			}
+			retired, resized = wp.retire(false)
+		case <-resized:
+			retired, resized = wp.retire(false)
+		case <-timeout:
+			idle.Reset(wp.idleTimeout)
+			retired, resized = wp.retire(true)
+		}
+	}
+}
+
+// monitorWaits grows the pool while every worker is busy, workers check the wait
+// of a task only when they take it. A task queued when the monitor saw a non-empty
+// backlog has waited at least as long as nothing has been taken since then
+func (wp *WorkerPool) monitorWaits() {
+	ticker := time.NewTicker(max(wp.scaleUpWait/4, time.Millisecond))
+	defer ticker.Stop()
+
+	var pendingSince time.Time
+	var takenSince uint64
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-wp.closing:
+			return
+		}
+
+		taken := wp.taken.Load()
+		switch {
+		case len(wp.tasks) == 0:
+			pendingSince = time.Time{}
+		case pendingSince.IsZero() || taken != takenSince:
+			pendingSince, takenSince = now, taken
+		case now.Sub(pendingSince) >= wp.scaleUpWait:
+			wp.grow()
+			pendingSince = now
+		}
+	}
+}
+
+func (wp *WorkerPool) execute(task job) {
+	if task.claim != nil && !task.claim() {
+		wp.cancelled.Add(1)
+		return
+	}
+
+	defer func() {
+		wp.completed.Add(1)
+		if value := recover(); value != nil {
+			wp.onPanic(&PanicError{Value: value, Stack: debug.Stack()})
+		}
+	}()
+	task.run()
 }
 
 // Return an error if the pool is full
 func (wp *WorkerPool) AddTask(task func()) error {
-	// need to implement
+	return wp.AddTaskContext(context.Background(), task)
+}
+
+// AddTaskContext is AddTask that gives up once ctx is done,
+// it only matters for the BlockPolicy since other policies never wait
+func (wp *WorkerPool) AddTaskContext(ctx context.Context, task func()) error {
+	return wp.submit(ctx, job{run: task})
+}
+
+func (wp *WorkerPool) submit(ctx context.Context, task job) error {
+	wp.mutex.Lock()
+	if wp.closed {
+		wp.mutex.Unlock()
+		return ErrPoolClosed
+	}
+	wp.senders.Add(1) // shutdown must not close the tasks channel under our feet
+	wp.mutex.Unlock()
+	defer wp.senders.Done()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	task.queuedAt = time.Now()
+	if err := wp.enqueue(ctx, task); err != nil {
+		return err
+	}
+
+	if wp.Workers() == 0 || len(wp.tasks) >= wp.scaleUpBacklog {
+		wp.grow()
+	}
+
 	return nil
 }
 
+func (wp *WorkerPool) enqueue(ctx context.Context, task job) error {
+	select {
+	case wp.tasks <- task:
+		return nil
+	default:
+	}
+
+	switch wp.policy {
+	case BlockPolicy:
+		select {
+		case wp.tasks <- task:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wp.closing:
+			return ErrPoolClosed
+		}
+	case DropOldestPolicy:
+		for {
+			select {
+			case wp.tasks <- task:
+				return nil
+			default:
+			}
+
+			select {
+			case oldest := <-wp.tasks:
+				wp.taken.Add(1)
+				if oldest.claim != nil && !oldest.claim() {
+					wp.cancelled.Add(1)
+					continue
+				}
+				wp.dropped.Add(1)
+				if oldest.abandon != nil {
+					oldest.abandon(ErrTaskDropped)
+				}
+			default: // a worker has just taken it, try again
+			}
+		}
+	case CallerRunsPolicy:
+		wp.execute(task)
+		return nil
+	default:
+		return ErrPoolFull
+	}
+}
+
 // Shutdown all workers and wait for all
 // tasks in the pool to complete
-func (wp *WorkerPool) Shutdown() {
-	// need to implement
+func (wp *WorkerPool) Shutdown() error {
+	report, _ := wp.ShutdownContext(context.Background())
+	if report.Dropped+report.Cancelled > 0 {
+		return &AbandonedTasksError{Dropped: report.Dropped, Cancelled: report.Cancelled}
+	}
+	return nil
+}
+
+// ShutdownContext stops accepting tasks and drains the backlog until ctx is done,
+// then it interrupts running tasks and drops the ones that have not started
+func (wp *WorkerPool) ShutdownContext(ctx context.Context) (ShutdownReport, error) {
+	wp.stopIntake()
+
+	drained := make(chan struct{})
+	go func() {
+		wp.workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return wp.report(), nil
+	case <-ctx.Done():
+	}
+
+	wp.interrupt()
+	<-drained
+
+	for _, task := range wp.takeLeftovers() {
+		if task.abandon != nil {
+			task.abandon(ErrPoolClosed)
+		}
+	}
+	return wp.report(), ctx.Err()
+}
+
+// ShutdownNow stops accepting tasks, interrupts running ones through their context
+// and returns the tasks that have not started, futures of these tasks stay pending
+// until the returned functions are called. Tasks cancelled while queued are not returned
+func (wp *WorkerPool) ShutdownNow() ([]func(), ShutdownReport) {
+	wp.interrupt()
+	wp.stopIntake()
+	wp.workers.Wait()
+
+	leftovers := wp.takeLeftovers()
+	unstarted := make([]func(), 0, len(leftovers))
+	for _, task := range leftovers {
+		// already claimed, Cancel cannot take it back
+		if task.detached != nil {
+			unstarted = append(unstarted, task.detached)
+		} else {
+			unstarted = append(unstarted, task.run)
+		}
+	}
+	return unstarted, wp.report()
+}
+
+func (wp *WorkerPool) stopIntake() {
+	wp.closeOnce.Do(func() {
+		wp.mutex.Lock()
+		wp.closed = true
+		close(wp.closing)
+		wp.mutex.Unlock()
+
+		wp.senders.Wait()
+		close(wp.tasks)
+
+		wp.mutex.Lock()
+		if wp.running == 0 && len(wp.tasks) > 0 {
+			wp.spawnLocked() // an elastic pool may have retired every worker
+		}
+		wp.mutex.Unlock()
+	})
+}
+
+// takeLeftovers claims the tasks that will not be run by the pool,
+// the ones cancelled in the meantime are counted and left out
+func (wp *WorkerPool) takeLeftovers() []job {
+	wp.mutex.Lock()
+	leftovers := wp.leftovers
+	wp.leftovers = nil
+	wp.mutex.Unlock()
+
+	claimed := leftovers[:0]
+	for _, task := range leftovers {
+		if task.claim != nil && !task.claim() {
+			wp.cancelled.Add(1)
+			continue
+		}
+		claimed = append(claimed, task)
+	}
+	wp.dropped.Add(int64(len(claimed)))
+	return claimed
+}
+
+func (wp *WorkerPool) report() ShutdownReport {
+	return ShutdownReport{
+		Completed: int(wp.completed.Load()),
+		Cancelled: int(wp.cancelled.Load()),
+		Dropped:   int(wp.dropped.Load()),
+	}
+}
+
+const (
+	futurePending int32 = iota
+	futureClaimed       // either a worker started the task or it was abandoned
+	futureResolved
+)
+
+// Future is the pending result of a task passed to Submit
+type Future[T any] struct {
+	state  atomic.Int32
+	done   chan struct{}
+	value  T
+	err    error
+	cancel context.CancelFunc
+}
+
+// Submit schedules action on the pool, the context given to the action
+// is cancelled by Future.Cancel, a panic inside the action becomes a *PanicError
+func Submit[T any](wp *WorkerPool, action func(ctx context.Context) (T, error)) *Future[T] {
+	return SubmitContext(context.Background(), wp, action)
+}
+
+// SubmitContext is Submit that also passes ctx to the action
+// and gives up waiting for room in the backlog once ctx is done
+func SubmitContext[T any](ctx context.Context, wp *WorkerPool, action func(ctx context.Context) (T, error)) *Future[T] {
+	taskCtx, cancel := context.WithCancel(ctx)
+	f := &Future[T]{
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+
+	// ShutdownNow interrupts running tasks, the ones it hands back
+	// have not been linked to the pool yet, so they run with a live context
+	run := func(interruptible bool) {
+		if interruptible {
+			stopInterrupt := context.AfterFunc(wp.ctx, cancel)
+			defer stopInterrupt()
+		}
+
+		var value T
+		var err error
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				err = &PanicError{Value: recovered, Stack: debug.Stack()}
+			}
+			f.resolve(value, err)
+		}()
+		value, err = action(taskCtx)
+	}
+
+	task := job{
+		claim: func() bool {
+			return f.state.CompareAndSwap(futurePending, futureClaimed)
+		},
+		run:      func() { run(true) },
+		detached: func() { run(false) },
+		abandon: func(err error) {
+			var zero T
+			f.resolve(zero, err)
+		},
+	}
+
+	if err := wp.submit(ctx, task); err != nil && task.claim() {
+		task.abandon(err)
+	}
+
+	return f
+}
+
+func (f *Future[T]) resolve(value T, err error) {
+	f.value, f.err = value, err
+	f.state.Store(futureResolved)
+	f.cancel()
+	close(f.done)
+}
+
+// Done is closed once the result is available
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Get waits for the result of the task or for ctx to be done,
+// whichever happens first
+func (f *Future[T]) Get(ctx context.Context) (T, error) {
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// Cancel cancels the context of the task, a task that has
+// not started yet is resolved with context.Canceled right away
+func (f *Future[T]) Cancel() {
+	f.cancel()
+	if f.state.CompareAndSwap(futurePending, futureClaimed) {
+		var zero T
+		f.resolve(zero, context.Canceled)
+	}
 }
 
 func TestWorkerPool(t *testing.T) {
@@ -56,3 +681,364 @@ func TestWorkerPool(t *testing.T) {
 
 	assert.Equal(t, int32(6), counter.Load())
 }
+
+func TestWorkerPoolOverflowPolicies(t *testing.T) {
+	release := make(chan struct{})
+	blocker := func() { <-release }
+
+	t.Run("reject", func(t *testing.T) {
+		pool := NewWorkerPool(1, WithBacklog(1), WithOverflowPolicy(RejectPolicy))
+		started := make(chan struct{})
+		assert.NoError(t, pool.AddTask(func() { close(started); <-release }))
+		<-started
+		assert.NoError(t, pool.AddTask(blocker))
+		assert.ErrorIs(t, pool.AddTask(blocker), ErrPoolFull)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		pool := NewWorkerPool(1, WithBacklog(1), WithOverflowPolicy(BlockPolicy))
+		started := make(chan struct{})
+		assert.NoError(t, pool.AddTask(func() { close(started); <-release }))
+		<-started
+		assert.NoError(t, pool.AddTask(blocker))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		assert.ErrorIs(t, pool.AddTaskContext(ctx, blocker), context.DeadlineExceeded)
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		pool := NewWorkerPool(1, WithBacklog(2), WithOverflowPolicy(DropOldestPolicy))
+		started := make(chan struct{})
+		gate := make(chan struct{})
+		assert.NoError(t, pool.AddTask(func() { close(started); <-gate }))
+		<-started
+
+		var executed []int
+		var mutex sync.Mutex
+		for i := 1; i <= 4; i++ {
+			assert.NoError(t, pool.AddTask(func() {
+				mutex.Lock()
+				executed = append(executed, i)
+				mutex.Unlock()
+			}))
+		}
+
+		close(gate)
+		pool.Shutdown()
+		assert.Equal(t, []int{3, 4}, executed)
+	})
+
+	t.Run("caller runs", func(t *testing.T) {
+		pool := NewWorkerPool(1, WithBacklog(1), WithOverflowPolicy(CallerRunsPolicy))
+		started := make(chan struct{})
+		assert.NoError(t, pool.AddTask(func() { close(started); <-release }))
+		<-started
+		assert.NoError(t, pool.AddTask(blocker))
+
+		var ranInCaller bool
+		assert.NoError(t, pool.AddTask(func() { ranInCaller = true }))
+		assert.True(t, ranInCaller)
+	})
+
+	close(release)
+}
+
+func TestWorkerPoolClosed(t *testing.T) {
+	pool := NewWorkerPool(1, WithBacklog(1), WithOverflowPolicy(BlockPolicy))
+	release := make(chan struct{})
+	started := make(chan struct{})
+	assert.NoError(t, pool.AddTask(func() { close(started); <-release }))
+	<-started
+	assert.NoError(t, pool.AddTask(func() {}))
+
+	blocked := make(chan error)
+	go func() {
+		blocked <- pool.AddTask(func() {})
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+	go pool.Shutdown()
+	assert.ErrorIs(t, <-blocked, ErrPoolClosed)
+
+	close(release)
+	pool.Shutdown()
+	assert.ErrorIs(t, pool.AddTask(func() {}), ErrPoolClosed)
+}
+
+func TestElasticWorkerPool(t *testing.T) {
+	pool := NewElasticWorkerPool(1, 4, time.Millisecond*200)
+	assert.Equal(t, 1, pool.Workers())
+
+	release := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		assert.NoError(t, pool.AddTask(func() { <-release }))
+	}
+	assert.Equal(t, 4, pool.Workers())
+
+	close(release)
+	time.Sleep(time.Millisecond * 600)
+	assert.Equal(t, 1, pool.Workers())
+
+	var counter atomic.Int32
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, pool.AddTask(func() { counter.Add(1) }))
+	}
+	pool.Shutdown()
+	assert.Equal(t, int32(4), counter.Load())
+	assert.Equal(t, 0, pool.Workers())
+}
+
+func TestElasticWorkerPoolScaleUpOnWait(t *testing.T) {
+	pool := NewElasticWorkerPool(1, 2, 0, WithScaleUpThresholds(defaultBacklog, time.Millisecond*50))
+	defer pool.Shutdown()
+
+	assert.NoError(t, pool.AddTask(func() { time.Sleep(time.Millisecond * 100) }))
+	assert.NoError(t, pool.AddTask(func() {}))
+	assert.Equal(t, 1, pool.Workers())
+
+	time.Sleep(time.Millisecond * 150)
+	assert.Equal(t, 2, pool.Workers())
+}
+
+func TestElasticWorkerPoolLastWorkerStays(t *testing.T) {
+	pool := NewElasticWorkerPool(0, 2, time.Hour, WithScaleUpThresholds(2, 0))
+	release := make(chan struct{})
+	started := make(chan struct{})
+	assert.NoError(t, pool.AddTask(func() { close(started); <-release }))
+	<-started
+
+	var counter atomic.Int32
+	assert.NoError(t, pool.AddTask(func() { counter.Add(1) }))
+	assert.Equal(t, 1, pool.Workers()) // the backlog is below the threshold
+
+	// the idle timeout of the only worker must not strand the queued task
+	retired, _ := pool.retire(true)
+	assert.False(t, retired)
+
+	close(release)
+	assert.NoError(t, pool.Shutdown())
+	assert.Equal(t, int32(1), counter.Load())
+}
+
+func TestElasticWorkerPoolScaleUpWhileBusy(t *testing.T) {
+	pool := NewElasticWorkerPool(1, 4, 0, WithScaleUpThresholds(defaultBacklog, time.Millisecond*20))
+	release := make(chan struct{})
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, pool.AddTask(func() { <-release }))
+	}
+
+	// every worker is blocked, so only the monitor sees the tasks waiting
+	assert.Eventually(t, func() bool {
+		return pool.Workers() == 4
+	}, time.Millisecond*500, time.Millisecond*10)
+
+	close(release)
+	assert.NoError(t, pool.Shutdown())
+}
+
+func TestWorkerPoolResize(t *testing.T) {
+	pool := NewWorkerPool(2)
+	defer pool.Shutdown()
+
+	pool.Resize(5)
+	assert.Equal(t, 5, pool.Workers())
+
+	release := make(chan struct{})
+	assert.NoError(t, pool.AddTask(func() { <-release }))
+
+	pool.Resize(1)
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, 1, pool.Workers())
+
+	close(release)
+	var counter atomic.Int32
+	assert.NoError(t, pool.AddTask(func() { counter.Add(1) }))
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, int32(1), counter.Load())
+	assert.Equal(t, 1, pool.Workers())
+}
+
+func TestSubmit(t *testing.T) {
+	pool := NewWorkerPool(2)
+
+	value := Submit(pool, func(ctx context.Context) (int, error) {
+		return 42, nil
+	})
+	failure := Submit(pool, func(ctx context.Context) (string, error) {
+		return "", errors.New("error")
+	})
+	panicking := Submit(pool, func(ctx context.Context) (int, error) {
+		panic("boom")
+	})
+
+	result, err := value.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 42, result)
+
+	_, err = failure.Get(context.Background())
+	assert.EqualError(t, err, "error")
+
+	<-panicking.Done()
+	_, err = panicking.Get(context.Background())
+	var panicErr *PanicError
+	assert.ErrorAs(t, err, &panicErr)
+	assert.Equal(t, "boom", panicErr.Value)
+	assert.Contains(t, string(panicErr.Stack), "TestSubmit")
+
+	assert.NoError(t, pool.Shutdown())
+}
+
+func TestSubmitCancel(t *testing.T) {
+	pool := NewWorkerPool(1)
+
+	running := Submit(pool, func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	queued := Submit(pool, func(ctx context.Context) (int, error) {
+		return 1, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err := running.Get(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	queued.Cancel()
+	_, err = queued.Get(context.Background())
+	assert.ErrorIs(t, err, context.Canceled)
+
+	running.Cancel()
+	_, err = running.Get(context.Background())
+	assert.ErrorIs(t, err, context.Canceled)
+
+	var abandoned *AbandonedTasksError
+	assert.ErrorAs(t, pool.Shutdown(), &abandoned)
+	assert.Equal(t, AbandonedTasksError{Dropped: 0, Cancelled: 1}, *abandoned)
+}
+
+func TestWorkerPoolPanicIsolation(t *testing.T) {
+	panics := make(chan *PanicError, 1)
+	pool := NewWorkerPool(1, WithPanicHandler(func(err *PanicError) {
+		panics <- err
+	}))
+
+	assert.NoError(t, pool.AddTask(func() { panic(errors.New("boom")) }))
+	err := <-panics
+	assert.EqualError(t, errors.Unwrap(err), "boom")
+
+	var counter atomic.Int32
+	assert.NoError(t, pool.AddTask(func() { counter.Add(1) }))
+	assert.NoError(t, pool.Shutdown())
+	assert.Equal(t, int32(1), counter.Load())
+}
+
+func TestWorkerPoolPanicLogged(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	pool := NewWorkerPool(1)
+	assert.NoError(t, pool.AddTask(func() { panic("boom") }))
+	assert.NoError(t, pool.Shutdown())
+
+	assert.Contains(t, output.String(), "task panicked: boom")
+	assert.Contains(t, output.String(), "TestWorkerPoolPanicLogged")
+}
+
+func TestSubmitDropped(t *testing.T) {
+	pool := NewWorkerPool(1, WithBacklog(1), WithOverflowPolicy(DropOldestPolicy))
+	release := make(chan struct{})
+	started := make(chan struct{})
+	assert.NoError(t, pool.AddTask(func() { close(started); <-release }))
+	<-started
+
+	oldest := Submit(pool, func(ctx context.Context) (int, error) { return 1, nil })
+	newest := Submit(pool, func(ctx context.Context) (int, error) { return 2, nil })
+
+	_, err := oldest.Get(context.Background())
+	assert.ErrorIs(t, err, ErrTaskDropped)
+
+	close(release)
+	result, err := newest.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result)
+
+	var abandoned *AbandonedTasksError
+	assert.ErrorAs(t, pool.Shutdown(), &abandoned)
+	assert.Equal(t, 1, abandoned.Dropped)
+}
+
+func TestShutdownContext(t *testing.T) {
+	pool := NewWorkerPool(1)
+
+	var counter atomic.Int32
+	assert.NoError(t, pool.AddTask(func() { counter.Add(1) }))
+	report, err := pool.ShutdownContext(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, ShutdownReport{Completed: 1}, report)
+	assert.Equal(t, int32(1), counter.Load())
+
+	pool = NewWorkerPool(1)
+	long := Submit(pool, func(ctx context.Context) (int, error) {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(time.Second * 10):
+			return 1, nil
+		}
+	})
+	queued := Submit(pool, func(ctx context.Context) (int, error) { return 2, nil })
+	Submit(pool, func(ctx context.Context) (int, error) { return 3, nil }).Cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	report, err = pool.ShutdownContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, ShutdownReport{Completed: 1, Cancelled: 1, Dropped: 1}, report)
+
+	_, err = long.Get(context.Background())
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = queued.Get(context.Background())
+	assert.ErrorIs(t, err, ErrPoolClosed)
+}
+
+func TestShutdownNow(t *testing.T) {
+	pool := NewWorkerPool(1)
+
+	started := make(chan struct{})
+	long := Submit(pool, func(ctx context.Context) (int, error) {
+		close(started)
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	queued := Submit(pool, func(ctx context.Context) (int, error) { return 2, ctx.Err() }) // handed back alive
+	cancelled := Submit(pool, func(ctx context.Context) (int, error) { return 3, nil })
+	var counter atomic.Int32
+	assert.NoError(t, pool.AddTask(func() { counter.Add(1) }))
+
+	<-started
+	cancelled.Cancel()
+	unstarted, report := pool.ShutdownNow()
+	assert.Len(t, unstarted, 2) // the cancelled one is not given back
+	assert.Equal(t, ShutdownReport{Completed: 1, Cancelled: 1, Dropped: 2}, report)
+	assert.ErrorIs(t, pool.AddTask(func() {}), ErrPoolClosed)
+
+	_, err := long.Get(context.Background())
+	assert.ErrorIs(t, err, context.Canceled)
+
+	select {
+	case <-queued.Done():
+		assert.Fail(t, "unstarted task must stay pending")
+	default:
+	}
+
+	for _, task := range unstarted {
+		task()
+	}
+	result, err := queued.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result)
+	assert.Equal(t, int32(1), counter.Load())
+}
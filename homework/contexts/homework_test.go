@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -10,22 +12,118 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+type GroupOption func(*Group)
+
+// WithAllErrors makes Wait return every error joined together instead of
+// only the first one, errors no longer cancel the group context in this mode
+func WithAllErrors() GroupOption {
+	return func(g *Group) {
+		g.collectAll = true
+	}
+}
+
 type Group struct {
-	// need to implement
+	cancel     context.CancelCauseFunc
+	collectAll bool
+	wg         sync.WaitGroup
+	sem        chan struct{} // nil means no limit on active goroutines
+
+	mutex sync.Mutex
+	errs  []error
+}
+
+func NewErrGroup(ctx context.Context, options ...GroupOption) (*Group, context.Context) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	g := &Group{cancel: cancel}
+	for idx := range options {
+		options[idx](g)
+	}
+	return g, ctx
 }
 
-func NewErrGroup(ctx context.Context) (*Group, context.Context) {
-	// need to implement
-	return &Group{}, ctx
+// SetLimit limits the number of active goroutines to n, a negative n removes the limit,
+// the limit must not be changed while goroutines are active
+func (g *Group) SetLimit(n int) {
+	if n < 0 {
+		g.sem = nil
+		return
+	}
+	if len(g.sem) != 0 {
+		panic(fmt.Errorf("errgroup: modify limit while %d goroutines in the group are still active", len(g.sem)))
+	}
+	g.sem = make(chan struct{}, n)
 }
 
+// Go runs action in a new goroutine, it blocks until
+// the goroutine can be added without exceeding the limit
 func (g *Group) Go(action func() error) {
-	// need to implement
+	if g.sem != nil {
+		g.sem <- struct{}{}
+	}
+	g.run(action)
+}
+
+// TryGo runs action in a new goroutine only if the limit allows it
+// and reports whether the goroutine was started
+func (g *Group) TryGo(action func() error) bool {
+	if g.sem != nil {
+		select {
+		case g.sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	g.run(action)
+	return true
 }
 
+func (g *Group) run(action func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.done()
+		if err := action(); err != nil {
+			g.fail(err)
+		}
+	}()
+}
+
+func (g *Group) done() {
+	if g.sem != nil {
+		<-g.sem
+	}
+	g.wg.Done()
+}
+
+func (g *Group) fail(err error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.collectAll {
+		g.errs = append(g.errs, err)
+		return
+	}
+	if len(g.errs) == 0 {
+		g.errs = append(g.errs, err)
+		g.cancel(err)
+	}
+}
+
+// Wait blocks until all goroutines have returned and returns
+// the first error or, in the WithAllErrors mode, all of them joined
 func (g *Group) Wait() error {
-	// need to implement
-	return nil
+	g.wg.Wait()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var err error
+	if g.collectAll {
+		err = errors.Join(g.errs...)
+	} else if len(g.errs) > 0 {
+		err = g.errs[0]
+	}
+	g.cancel(err)
+	return err
 }
 
 func TestErrGroupWithoutError(t *testing.T) {
@@ -72,3 +170,71 @@ func TestErrGroupWithError(t *testing.T) {
 	assert.Equal(t, int32(0), counter.Load())
 	assert.Error(t, err)
 }
+
+func TestErrGroupWithLimit(t *testing.T) {
+	var active, maxActive atomic.Int32
+	group, _ := NewErrGroup(context.Background())
+	group.SetLimit(2)
+
+	for i := 0; i < 6; i++ {
+		group.Go(func() error {
+			current := active.Add(1)
+			for {
+				previous := maxActive.Load()
+				if current <= previous || maxActive.CompareAndSwap(previous, current) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond * 100)
+			active.Add(-1)
+			return nil
+		})
+	}
+
+	assert.NoError(t, group.Wait())
+	assert.Equal(t, int32(2), maxActive.Load())
+}
+
+func TestErrGroupTryGo(t *testing.T) {
+	group, _ := NewErrGroup(context.Background())
+	group.SetLimit(1)
+
+	release := make(chan struct{})
+	assert.True(t, group.TryGo(func() error {
+		<-release
+		return nil
+	}))
+	assert.False(t, group.TryGo(func() error {
+		return nil
+	}))
+
+	close(release)
+	assert.NoError(t, group.Wait())
+	assert.True(t, group.TryGo(func() error {
+		return nil
+	}))
+	assert.NoError(t, group.Wait())
+}
+
+func TestErrGroupWithAllErrors(t *testing.T) {
+	errFirst := errors.New("first")
+	errSecond := errors.New("second")
+
+	group, ctx := NewErrGroup(context.Background(), WithAllErrors())
+	group.Go(func() error {
+		return errFirst
+	})
+	group.Go(func() error {
+		time.Sleep(time.Millisecond * 100)
+		assert.NoError(t, ctx.Err())
+		return errSecond
+	})
+	group.Go(func() error {
+		return nil
+	})
+
+	err := group.Wait()
+	assert.ErrorIs(t, err, errFirst)
+	assert.ErrorIs(t, err, errSecond)
+	assert.Error(t, ctx.Err())
+}
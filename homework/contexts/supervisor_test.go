@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v homework_test.go supervisor_test.go
+
+// Strategy decides which children are restarted when one of them exits
+type Strategy int
+
+const (
+	OneForOne  Strategy = iota // restart only the exited child
+	OneForAll                  // restart every child
+	RestForOne                 // restart the exited child and the children declared after it
+)
+
+// RestartPolicy decides whether an exited child is restarted at all
+type RestartPolicy int
+
+const (
+	Permanent RestartPolicy = iota // always restarted
+	Transient                      // restarted only if it returned an error
+	Temporary                      // never restarted
+)
+
+var (
+	ErrTooManyRestarts = errors.New("supervisor: restart intensity exceeded")
+	errChildExited     = errors.New("child exited")
+)
+
+type ChildSpec struct {
+	Name    string
+	Run     func(ctx context.Context) error
+	Restart RestartPolicy
+}
+
+type SupervisorOption func(*Supervisor)
+
+func WithStrategy(strategy Strategy) SupervisorOption {
+	return func(s *Supervisor) {
+		s.strategy = strategy
+	}
+}
+
+// WithIntensity makes the supervisor give up once more than
+// maxRestarts restarts happen within the window
+func WithIntensity(maxRestarts int, window time.Duration) SupervisorOption {
+	return func(s *Supervisor) {
+		s.maxRestarts = maxRestarts
+		s.window = window
+	}
+}
+
+// WithBackoff delays a restart by initial, doubling the delay
+// for every consecutive restart of the same child up to max
+func WithBackoff(initial, max time.Duration) SupervisorOption {
+	return func(s *Supervisor) {
+		s.backoffInitial = initial
+		s.backoffMax = max
+	}
+}
+
+type Supervisor struct {
+	children       []ChildSpec
+	strategy       Strategy
+	maxRestarts    int
+	window         time.Duration
+	backoffInitial time.Duration
+	backoffMax     time.Duration
+}
+
+func NewSupervisor(children []ChildSpec, options ...SupervisorOption) *Supervisor {
+	s := &Supervisor{
+		children:    children,
+		strategy:    OneForOne,
+		maxRestarts: 3,
+		window:      time.Second * 5,
+	}
+	for idx := range options {
+		options[idx](s)
+	}
+	return s
+}
+
+// Child wraps the supervisor into a spec, so it can be supervised by another one
+func (s *Supervisor) Child(name string) ChildSpec {
+	return ChildSpec{Name: name, Run: s.Run, Restart: Permanent}
+}
+
+type childExit struct {
+	index int
+	err   error
+}
+
+type childState struct {
+	cancel    context.CancelFunc
+	running   bool
+	startedAt time.Time
+	restarts  int  // consecutive restarts, drives the backoff
+	finished  bool // exited for good, a failing sibling does not bring it back
+}
+
+// Run starts all children and keeps them alive until ctx is done,
+// it returns ErrTooManyRestarts if children keep exiting too often
+func (s *Supervisor) Run(ctx context.Context) error {
+	group, groupCtx := NewErrGroup(ctx)
+	exits := make(chan childExit, len(s.children)) // every child has at most one exit in flight
+	states := make([]childState, len(s.children))
+
+	start := func(index int) {
+		childCtx, cancel := context.WithCancel(groupCtx)
+		states[index].cancel = cancel
+		states[index].running = true
+		states[index].startedAt = time.Now()
+
+		spec := s.children[index]
+		group.Go(func() error {
+			exits <- childExit{index: index, err: runChild(childCtx, spec)}
+			return nil // an exited child must not cancel its siblings through the group
+		})
+	}
+
+	// stop cancels the given children and waits for them, exits of
+	// other children that happen meanwhile are returned for later handling
+	stop := func(indexes []int) []childExit {
+		var deferred []childExit
+		waiting := 0
+		for _, index := range indexes {
+			if states[index].running {
+				states[index].cancel()
+				waiting++
+			}
+		}
+		for waiting > 0 {
+			exit := <-exits
+			states[exit.index].running = false
+			if contains(indexes, exit.index) {
+				waiting--
+			} else {
+				deferred = append(deferred, exit)
+			}
+		}
+		return deferred
+	}
+
+	all := make([]int, len(s.children))
+	for index := range s.children {
+		all[index] = index
+		start(index)
+	}
+
+	defer func() {
+		stop(all)
+		_ = group.Wait()
+	}()
+
+	var restarts []time.Time
+	var pending []childExit
+	for {
+		var exit childExit
+		if len(pending) > 0 {
+			exit, pending = pending[0], pending[1:]
+		} else {
+			select {
+			case <-ctx.Done():
+				return nil
+			case exit = <-exits:
+			}
+		}
+
+		state := &states[exit.index]
+		state.cancel()
+		state.running = false
+
+		spec := s.children[exit.index]
+		if finalExit(spec, exit.err) {
+			state.finished = true
+			continue
+		}
+
+		now := time.Now()
+		restarts = append(restarts, now)
+		for len(restarts) > 0 && now.Sub(restarts[0]) > s.window {
+			restarts = restarts[1:]
+		}
+		if len(restarts) > s.maxRestarts {
+			cause := exit.err
+			if cause == nil {
+				cause = errChildExited
+			}
+			return fmt.Errorf("%w: child %q: %w", ErrTooManyRestarts, spec.Name, cause)
+		}
+
+		if now.Sub(state.startedAt) > s.window {
+			state.restarts = 0 // the child was healthy long enough to forget its past failures
+		}
+		delay := s.backoff(state.restarts)
+		state.restarts++
+
+		affected := s.affected(exit.index)
+		pending = append(pending, stop(affected)...)
+		for _, other := range pending {
+			if contains(affected, other.index) && finalExit(s.children[other.index], other.err) {
+				states[other.index].finished = true
+			}
+		}
+		pending = dropExitsOf(pending, affected) // these children get fresh instances anyway
+
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil
+			case <-timer.C:
+			}
+		}
+
+		for _, index := range affected {
+			// siblings stopped here are restarted unless they are temporary or already done
+			if index == exit.index || (!states[index].finished && s.children[index].Restart != Temporary) {
+				start(index)
+			}
+		}
+	}
+}
+
+// finalExit reports whether a child that exited on its own stays down
+func finalExit(spec ChildSpec, err error) bool {
+	return spec.Restart == Temporary || (spec.Restart == Transient && err == nil)
+}
+
+// affected returns the children to restart in their declaration order
+func (s *Supervisor) affected(index int) []int {
+	var indexes []int
+	switch s.strategy {
+	case OneForAll:
+		for idx := range s.children {
+			indexes = append(indexes, idx)
+		}
+	case RestForOne:
+		for idx := index; idx < len(s.children); idx++ {
+			indexes = append(indexes, idx)
+		}
+	default:
+		indexes = append(indexes, index)
+	}
+	return indexes
+}
+
+func (s *Supervisor) backoff(restarts int) time.Duration {
+	if s.backoffInitial <= 0 {
+		return 0
+	}
+
+	delay := s.backoffInitial
+	for i := 0; i < restarts && delay < s.backoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, s.backoffMax)
+}
+
+func runChild(ctx context.Context, spec ChildSpec) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			err = fmt.Errorf("child %q panicked: %v\n%s", spec.Name, value, debug.Stack())
+		}
+	}()
+	return spec.Run(ctx)
+}
+
+func contains(indexes []int, index int) bool {
+	for _, idx := range indexes {
+		if idx == index {
+			return true
+		}
+	}
+	return false
+}
+
+func dropExitsOf(exits []childExit, indexes []int) []childExit {
+	kept := exits[:0]
+	for _, exit := range exits {
+		if !contains(indexes, exit.index) {
+			kept = append(kept, exit)
+		}
+	}
+	return kept
+}
+
+// failingChild fails the given number of times and then runs until cancelled
+func failingChild(starts *atomic.Int32, failures int32) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if starts.Add(1) <= failures {
+			return errors.New("error")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+}
+
+func TestSupervisorStrategies(t *testing.T) {
+	tests := map[Strategy][3]int32{
+		OneForOne:  {1, 3, 1},
+		OneForAll:  {3, 3, 3},
+		RestForOne: {1, 3, 3},
+	}
+
+	for strategy, expected := range tests {
+		var first, second, third atomic.Int32
+		supervisor := NewSupervisor([]ChildSpec{
+			{Name: "first", Run: failingChild(&first, 0)},
+			{Name: "second", Run: failingChild(&second, 2)},
+			{Name: "third", Run: failingChild(&third, 0)},
+		}, WithStrategy(strategy))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		assert.NoError(t, supervisor.Run(ctx))
+		cancel()
+
+		assert.Equal(t, expected, [3]int32{first.Load(), second.Load(), third.Load()}, "strategy %d", strategy)
+	}
+}
+
+func TestSupervisorRestartPolicies(t *testing.T) {
+	var permanent, transient, temporary atomic.Int32
+	supervisor := NewSupervisor([]ChildSpec{
+		{Name: "permanent", Restart: Permanent, Run: func(ctx context.Context) error {
+			if permanent.Add(1) == 1 {
+				return nil
+			}
+			<-ctx.Done()
+			return nil
+		}},
+		{Name: "transient", Restart: Transient, Run: func(ctx context.Context) error {
+			transient.Add(1)
+			return nil
+		}},
+		{Name: "temporary", Restart: Temporary, Run: func(ctx context.Context) error {
+			temporary.Add(1)
+			return errors.New("error")
+		}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	assert.NoError(t, supervisor.Run(ctx))
+
+	assert.Equal(t, int32(2), permanent.Load())
+	assert.Equal(t, int32(1), transient.Load())
+	assert.Equal(t, int32(1), temporary.Load())
+}
+
+func TestSupervisorSiblingRestartPolicies(t *testing.T) {
+	for _, strategy := range []Strategy{OneForAll, RestForOne} {
+		var failing, temporary, transient, sleeper atomic.Int32
+		supervisor := NewSupervisor([]ChildSpec{
+			{Name: "failing", Run: func(ctx context.Context) error {
+				if failing.Add(1) > 2 {
+					<-ctx.Done()
+					return nil
+				}
+				time.Sleep(time.Millisecond * 20) // the siblings below exit first
+				return errors.New("error")
+			}},
+			{Name: "temporary", Restart: Temporary, Run: func(ctx context.Context) error {
+				temporary.Add(1)
+				return nil
+			}},
+			{Name: "transient", Restart: Transient, Run: func(ctx context.Context) error {
+				transient.Add(1)
+				return nil
+			}},
+			{Name: "sleeper", Restart: Temporary, Run: func(ctx context.Context) error {
+				sleeper.Add(1)
+				<-ctx.Done()
+				return nil
+			}},
+		}, WithStrategy(strategy))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		assert.NoError(t, supervisor.Run(ctx))
+		cancel()
+
+		assert.Equal(t, int32(3), failing.Load(), "strategy %d", strategy)
+		assert.Equal(t, int32(1), temporary.Load(), "strategy %d", strategy)
+		assert.Equal(t, int32(1), transient.Load(), "strategy %d", strategy)
+		assert.Equal(t, int32(1), sleeper.Load(), "strategy %d", strategy) // stopped, not restarted
+	}
+}
+
+func TestSupervisorIntensity(t *testing.T) {
+	var starts atomic.Int32
+	supervisor := NewSupervisor([]ChildSpec{
+		{Name: "broken", Run: func(ctx context.Context) error {
+			starts.Add(1)
+			panic("boom")
+		}},
+	}, WithIntensity(3, time.Second))
+
+	err := supervisor.Run(context.Background())
+	assert.ErrorIs(t, err, ErrTooManyRestarts)
+	assert.ErrorContains(t, err, "boom")
+	assert.Equal(t, int32(4), starts.Load())
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	var starts atomic.Int32
+	supervisor := NewSupervisor([]ChildSpec{
+		{Name: "broken", Run: failingChild(&starts, 3)},
+	}, WithBackoff(time.Millisecond*50, time.Millisecond*100))
+
+	begin := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for starts.Load() < 4 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+
+	assert.NoError(t, supervisor.Run(ctx))
+	assert.GreaterOrEqual(t, time.Since(begin), time.Millisecond*250) // 50 + 100 + 100
+}
+
+func TestNestedSupervisors(t *testing.T) {
+	var starts atomic.Int32
+	inner := NewSupervisor([]ChildSpec{
+		{Name: "broken", Run: failingChild(&starts, 2)},
+	}, WithIntensity(1, time.Second))
+	outer := NewSupervisor([]ChildSpec{inner.Child("inner")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	assert.NoError(t, outer.Run(ctx))
+
+	// the inner supervisor gives up after the second failure and the outer one restarts it
+	assert.Equal(t, int32(3), starts.Load())
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// go test -v homework_test.go cron_test.go
+
+// CronSchedule computes fire times of a recurring job
+type CronSchedule interface {
+	// Next returns the first fire time strictly after t
+	// or a zero time if there is none within a few years
+	Next(t time.Time) time.Time
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	secondField = cronField{name: "second", min: 0, max: 59}
+	minuteField = cronField{name: "minute", min: 0, max: 59}
+	hourField   = cronField{name: "hour", min: 0, max: 23}
+	domField    = cronField{name: "day of month", min: 1, max: 31}
+	monthField  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+const starBit = 1 << 63 // marks a field given as * so day matching can tell it apart from a full list
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// specSchedule keeps every field as a bit set of allowed values
+type specSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+	location                              *time.Location
+}
+
+type everySchedule struct {
+	interval time.Duration
+}
+
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+// ParseCron parses 5 field (minute first) and 6 field (second first) expressions,
+// descriptors like @daily or @every 1h30m and an optional CRON_TZ=<zone> prefix,
+// expressions without a zone use the given location
+func ParseCron(spec string, location *time.Location) (CronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		zone, rest, _ := strings.Cut(spec, " ")
+		_, name, _ := strings.Cut(zone, "=")
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, fmt.Errorf("cron: invalid time zone %q: %w", name, err)
+		}
+		location, spec = loc, strings.TrimSpace(rest)
+	}
+
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("cron: invalid interval: %w", err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("cron: interval must be positive, got %s", interval)
+		}
+		return everySchedule{interval: interval}, nil
+	}
+	if expanded, found := cronDescriptors[spec]; found {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("cron: expected 5 or 6 fields, got %d in %q", len(fields), spec)
+	}
+
+	schedule := &specSchedule{location: location}
+	targets := []*uint64{&schedule.second, &schedule.minute, &schedule.hour, &schedule.dom, &schedule.month, &schedule.dow}
+	for idx, field := range []cronField{secondField, minuteField, hourField, domField, monthField, dowField} {
+		bitSet, err := field.parse(fields[idx])
+		if err != nil {
+			return nil, err
+		}
+		*targets[idx] = bitSet
+	}
+
+	if schedule.dow&(1<<7) != 0 { // both 0 and 7 mean Sunday
+		schedule.dow = schedule.dow&^(1<<7) | 1
+	}
+	return schedule, nil
+}
+
+func (f cronField) parse(expr string) (uint64, error) {
+	var bitSet uint64
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, stepExpr, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepExpr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("cron: invalid step %q in %s field", stepExpr, f.name)
+			}
+		}
+
+		var low, high int
+		switch {
+		case rangeExpr == "*" || rangeExpr == "?":
+			low, high = f.min, f.max
+			if f.max == 7 {
+				high = 6 // the day of week wildcard must not set Sunday twice
+			}
+			if !hasStep {
+				bitSet |= starBit
+			}
+		default:
+			lowExpr, highExpr, isRange := strings.Cut(rangeExpr, "-")
+			var err error
+			if low, err = f.value(lowExpr); err != nil {
+				return 0, err
+			}
+			high = low
+			if isRange {
+				if high, err = f.value(highExpr); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				high = f.max // a/n means from a to the end with step n
+			}
+			if low > high {
+				return 0, fmt.Errorf("cron: invalid range %q in %s field", rangeExpr, f.name)
+			}
+		}
+
+		for value := low; value <= high; value += step {
+			bitSet |= 1 << value
+		}
+	}
+	return bitSet, nil
+}
+
+func (f cronField) value(expr string) (int, error) {
+	if value, found := f.names[strings.ToLower(expr)]; found {
+		return value, nil
+	}
+
+	value, err := strconv.Atoi(expr)
+	if err != nil || value < f.min || value > f.max {
+		return 0, fmt.Errorf("cron: invalid value %q in %s field, expected %d-%d", expr, f.name, f.min, f.max)
+	}
+	return value, nil
+}
+
+func (s *specSchedule) Next(t time.Time) time.Time {
+	origin := t.Location()
+	if s.location != nil {
+		t = t.In(s.location)
+	}
+	loc := t.Location()
+
+	// start from the next whole second and move field by field from the largest one,
+	// whenever a field wraps around the larger fields have to be checked again
+	t = t.Add(time.Second - time.Duration(t.Nanosecond()))
+	truncated := false
+	yearLimit := t.Year() + 5
+
+wrap:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+
+	for s.month&(1<<uint(t.Month())) == 0 {
+		if !truncated {
+			truncated = true
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		}
+		t = t.AddDate(0, 1, 0)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+
+	for !s.dayMatches(t) {
+		if !truncated {
+			truncated = true
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		}
+		t = t.AddDate(0, 0, 1)
+		if t.Hour() != 0 { // a daylight saving transition shifted midnight
+			if t.Hour() > 12 {
+				t = t.Add(time.Duration(24-t.Hour()) * time.Hour)
+			} else {
+				t = t.Add(time.Duration(-t.Hour()) * time.Hour)
+			}
+		}
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+
+	for s.hour&(1<<uint(t.Hour())) == 0 {
+		if !truncated {
+			truncated = true
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+		}
+		t = t.Add(time.Hour)
+		if t.Hour() == 0 {
+			goto wrap
+		}
+	}
+
+	for s.minute&(1<<uint(t.Minute())) == 0 {
+		if !truncated {
+			truncated = true
+			t = t.Truncate(time.Minute)
+		}
+		t = t.Add(time.Minute)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+
+	for s.second&(1<<uint(t.Second())) == 0 {
+		if !truncated {
+			truncated = true
+			t = t.Truncate(time.Second)
+		}
+		t = t.Add(time.Second)
+		if t.Second() == 0 {
+			goto wrap
+		}
+	}
+
+	return t.In(origin)
+}
+
+// dayMatches follows the classic cron rule: when both day fields are
+// restricted a day matching either of them is enough
+func (s *specSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.dom&starBit != 0 || s.dow&starBit != 0 {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// MissedRunPolicy decides what happens to fire times that passed
+// while the cron was not running, e.g. after a pause or a long GC stop
+type MissedRunPolicy int
+
+const (
+	MissedRunOnce MissedRunPolicy = iota // enqueue one task for the latest fire time
+	MissedRunAll                         // enqueue a task for every fire time, up to maxCatchUp
+	MissedSkip                           // enqueue tasks only for fire times within the grace period
+)
+
+const maxCatchUp = 100
+
+var ErrUnknownCronJob = errors.New("cron: unknown job")
+
+type CronOption func(*Cron)
+
+func WithCronClock(now func() time.Time) CronOption {
+	return func(c *Cron) {
+		c.now = now
+	}
+}
+
+// WithCronLocation sets the time zone of expressions without CRON_TZ
+func WithCronLocation(location *time.Location) CronOption {
+	return func(c *Cron) {
+		c.location = location
+	}
+}
+
+// WithGracePeriod sets how late a fire time may be handled before it counts as missed
+func WithGracePeriod(grace time.Duration) CronOption {
+	return func(c *Cron) {
+		c.grace = grace
+	}
+}
+
+type cronJob struct {
+	schedule CronSchedule
+	policy   MissedRunPolicy
+	makeTask func(at time.Time) Task
+	next     time.Time
+}
+
+// Cron enqueues tasks of recurring jobs into the scheduler at their fire times
+type Cron struct {
+	scheduler *Scheduler
+	now       func() time.Time
+	location  *time.Location
+	grace     time.Duration
+
+	mutex   sync.Mutex
+	jobs    map[int]*cronJob
+	lastID  int
+	changed chan struct{} // closed and replaced when jobs change to wake Run
+}
+
+func NewCron(scheduler *Scheduler, options ...CronOption) *Cron {
+	c := &Cron{
+		scheduler: scheduler,
+		now:       time.Now,
+		location:  time.Local,
+		grace:     time.Second,
+		jobs:      make(map[int]*cronJob),
+		changed:   make(chan struct{}),
+	}
+	for idx := range options {
+		options[idx](c)
+	}
+	return c
+}
+
+// AddJob registers a job, makeTask builds the task enqueued for every fire time
+// and must give the tasks distinct identifiers, the returned id removes the job
+func (c *Cron) AddJob(spec string, policy MissedRunPolicy, makeTask func(at time.Time) Task) (int, error) {
+	schedule, err := ParseCron(spec, c.location)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.lastID++
+	c.jobs[c.lastID] = &cronJob{
+		schedule: schedule,
+		policy:   policy,
+		makeTask: makeTask,
+		next:     schedule.Next(c.now()),
+	}
+	c.notifyLocked()
+	return c.lastID, nil
+}
+
+func (c *Cron) RemoveJob(id int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, found := c.jobs[id]; !found {
+		return fmt.Errorf("%w: %d", ErrUnknownCronJob, id)
+	}
+	delete(c.jobs, id)
+	c.notifyLocked()
+	return nil
+}
+
+// NextFire returns the next fire time of the job
+func (c *Cron) NextFire(id int) (time.Time, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	job, found := c.jobs[id]
+	if !found {
+		return time.Time{}, fmt.Errorf("%w: %d", ErrUnknownCronJob, id)
+	}
+	return job.next, nil
+}
+
+// RunPending enqueues tasks for all fire times up to now
+// and returns the number of enqueued tasks
+func (c *Cron) RunPending(now time.Time) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	enqueued := 0
+	for _, job := range c.jobs {
+		var due []time.Time
+		for !job.next.IsZero() && !job.next.After(now) {
+			due = append(due, job.next)
+			if len(due) > maxCatchUp {
+				due = due[1:]
+			}
+			job.next = job.schedule.Next(job.next)
+		}
+		if len(due) == 0 {
+			continue
+		}
+
+		switch job.policy {
+		case MissedRunAll:
+		case MissedSkip:
+			onTime := due[:0]
+			for _, at := range due {
+				if now.Sub(at) <= c.grace {
+					onTime = append(onTime, at)
+				}
+			}
+			due = onTime
+		default:
+			due = due[len(due)-1:]
+		}
+
+		for _, at := range due {
+			c.scheduler.AddTask(job.makeTask(at))
+			enqueued++
+		}
+	}
+	return enqueued
+}
+
+// Run enqueues tasks on time until ctx is done
+func (c *Cron) Run(ctx context.Context) error {
+	for {
+		c.RunPending(c.now())
+
+		c.mutex.Lock()
+		changed := c.changed
+		var next time.Time
+		for _, job := range c.jobs {
+			if !job.next.IsZero() && (next.IsZero() || job.next.Before(next)) {
+				next = job.next
+			}
+		}
+		c.mutex.Unlock()
+
+		var timer *time.Timer
+		var wakeup <-chan time.Time // nil blocks forever when there are no jobs
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(c.now()))
+			wakeup = timer.C
+		}
+
+		var err error
+		select {
+		case <-wakeup:
+		case <-changed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Cron) notifyLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func TestParseCron(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+	from := time.Date(2024, time.March, 15, 10, 7, 30, 0, time.UTC) // Friday
+
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, time.March, 15, 10, 15, 0, 0, time.UTC)},
+		{"0 9-17/2 * * MON-FRI", time.Date(2024, time.March, 15, 11, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"45 * * * * *", time.Date(2024, time.March, 15, 10, 7, 45, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2024, time.March, 17, 12, 0, 0, 0, time.UTC)},
+		{"0 0 13 * FRI", time.Date(2024, time.March, 22, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.March, 15, 11, 0, 0, 0, time.UTC)},
+		{"@every 90m", time.Date(2024, time.March, 15, 11, 37, 30, 0, time.UTC)},
+		{"CRON_TZ=Europe/Moscow 0 9 * * *", time.Date(2024, time.March, 16, 9, 0, 0, 0, moscow)},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseCron(test.spec, time.UTC)
+		require.NoError(t, err, test.spec)
+		assert.True(t, test.expected.Equal(schedule.Next(from)), "%s: expected %s, got %s", test.spec, test.expected, schedule.Next(from))
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * * * *", "*/0 * * * *", "5-1 * * * *", "@every -1s", "CRON_TZ=Mars/Base * * * * *"} {
+		_, err := ParseCron(spec, time.UTC)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestCronMissedRunPolicies(t *testing.T) {
+	start := time.Date(2024, time.March, 15, 10, 0, 0, 0, time.UTC)
+	tests := map[MissedRunPolicy]int{
+		MissedRunOnce: 1,
+		MissedRunAll:  5,
+		MissedSkip:    0,
+	}
+
+	for policy, expected := range tests {
+		clock := &fakeClock{now: start}
+		scheduler := NewScheduler(WithClock(clock.Now))
+		cron := NewCron(&scheduler, WithCronClock(clock.Now), WithCronLocation(time.UTC))
+
+		id := 0
+		_, err := cron.AddJob("*/10 * * * *", policy, func(at time.Time) Task {
+			id++
+			return Task{Identifier: id, Priority: at.Minute()}
+		})
+		require.NoError(t, err)
+
+		clock.Advance(time.Minute * 10)
+		assert.Equal(t, 1, cron.RunPending(clock.now), "policy %d", policy)
+		assert.Equal(t, Task{Identifier: 1, Priority: 10}, scheduler.GetTask())
+
+		clock.Advance(time.Minute*50 + time.Minute*5) // paused for five fire times
+		assert.Equal(t, expected, cron.RunPending(clock.now), "policy %d", policy)
+		assert.Equal(t, expected, scheduler.Len())
+	}
+}
+
+func TestCronRun(t *testing.T) {
+	scheduler := NewScheduler()
+	cron := NewCron(&scheduler)
+
+	var id int
+	jobID, err := cron.AddJob("@every 50ms", MissedRunOnce, func(at time.Time) Task {
+		id++
+		return Task{Identifier: id}
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- cron.Run(ctx)
+	}()
+
+	for expected := 1; expected <= 3; expected++ {
+		task, err := scheduler.GetTaskContext(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, expected, task.Identifier)
+	}
+
+	assert.NoError(t, cron.RemoveJob(jobID))
+	assert.ErrorIs(t, cron.RemoveJob(jobID), ErrUnknownCronJob)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
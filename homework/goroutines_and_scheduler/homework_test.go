@@ -1,7 +1,12 @@
 package main
 
 import (
+	"container/heap"
+	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -9,28 +14,308 @@ import (
 type Task struct {
 	Identifier int
 	Priority   int
+	RunAt      time.Time // the task is not handed out before this moment, zero means right away
+	Deadline   time.Time // used by the EDF mode, zero means no deadline
 }
 
+type scheduledTask struct {
+	task    Task    // returned as it was added, priority changes do not alter it
+	rank    float64 // priority raised by aging, see Scheduler.rankOf
+	readyAt time.Time
+	delayed bool   // waits for RunAt in the delayed heap
+	seq     uint64 // insertion order, keeps equal ranks FIFO
+	index   int    // position in its heap, maintained by the heap interface
+}
+
+type taskHeap struct {
+	items []*scheduledTask
+	less  func(a, b *scheduledTask) bool
+}
+
+func (h *taskHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *taskHeap) Less(i, j int) bool {
+	return h.less(h.items[i], h.items[j])
+}
+
+func (h *taskHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+func (h *taskHeap) Push(x any) {
+	item := x.(*scheduledTask)
+	item.index = len(h.items)
+	h.items = append(h.items, item)
+}
+
+func (h *taskHeap) Pop() any {
+	old := h.items
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	item.index = -1
+	h.items = old[:len(old)-1]
+	return item
+}
+
+func (h *taskHeap) remove(item *scheduledTask) {
+	heap.Remove(h, item.index)
+}
+
+func byRank(a, b *scheduledTask) bool {
+	if a.rank != b.rank {
+		return a.rank > b.rank
+	}
+	return a.seq < b.seq
+}
+
+// byDeadline puts tasks with the earliest deadline first
+// and falls back to ranks for tasks without a deadline
+func byDeadline(a, b *scheduledTask) bool {
+	switch {
+	case a.task.Deadline.IsZero() && b.task.Deadline.IsZero():
+		return byRank(a, b)
+	case a.task.Deadline.IsZero():
+		return false
+	case b.task.Deadline.IsZero():
+		return true
+	case !a.task.Deadline.Equal(b.task.Deadline):
+		return a.task.Deadline.Before(b.task.Deadline)
+	default:
+		return a.seq < b.seq
+	}
+}
+
+func byRunAt(a, b *scheduledTask) bool {
+	if !a.task.RunAt.Equal(b.task.RunAt) {
+		return a.task.RunAt.Before(b.task.RunAt)
+	}
+	return a.seq < b.seq
+}
+
+type SchedulerOption func(*Scheduler)
+
+// WithClock replaces time.Now, tests use it to control delays and aging
+func WithClock(now func() time.Time) SchedulerOption {
+	return func(s *Scheduler) {
+		s.now = now
+	}
+}
+
+// WithEarliestDeadlineFirst hands out tasks by their deadlines,
+// tasks without a deadline go after them ordered by priority
+func WithEarliestDeadlineFirst() SchedulerOption {
+	return func(s *Scheduler) {
+		s.ready.less = byDeadline
+	}
+}
+
+// WithAging raises the priority of a ready task by boost for every step it waits
+func WithAging(step time.Duration, boost int) SchedulerOption {
+	return func(s *Scheduler) {
+		s.agingRate = float64(boost) / float64(step)
+	}
+}
+
+// Scheduler is safe for concurrent use, all operations
+// except Len are O(log n) in the number of queued tasks
 type Scheduler struct {
-	// need to implement
+	mutex     *sync.Mutex // a pointer since NewScheduler returns the scheduler by value
+	ready     *taskHeap
+	delayed   *taskHeap
+	byID      map[int]*scheduledTask
+	seq       uint64
+	added     chan struct{} // closed and replaced on every AddTask to wake blocked consumers
+	now       func() time.Time
+	epoch     time.Time
+	agingRate float64 // priority gained per nanosecond of waiting
 }
 
-func NewScheduler() Scheduler {
-	// need to implement
-	return Scheduler{}
+func NewScheduler(options ...SchedulerOption) Scheduler {
+	s := Scheduler{
+		mutex:   new(sync.Mutex),
+		ready:   &taskHeap{less: byRank},
+		delayed: &taskHeap{less: byRunAt},
+		byID:    make(map[int]*scheduledTask),
+		added:   make(chan struct{}),
+		now:     time.Now,
+	}
+	for idx := range options {
+		options[idx](&s)
+	}
+	s.epoch = s.now()
+	return s
 }
 
+// rankOf ages tasks continuously: a task that became ready earlier gets
+// a bonus proportional to its head start, so the heap order never has to
+// be rebuilt as time passes although every waiting task keeps gaining priority
+func (s *Scheduler) rankOf(priority int, readyAt time.Time) float64 {
+	return float64(priority) - s.agingRate*float64(readyAt.Sub(s.epoch))
+}
+
+// EffectivePriority returns the priority of a queued task including
+// the aging bonus and reports whether the task was found
+func (s *Scheduler) EffectivePriority(taskID int) (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item, found := s.byID[taskID]
+	if !found {
+		return 0, false
+	}
+	if item.delayed {
+		return int(item.rank + s.agingRate*float64(item.readyAt.Sub(s.epoch))), true
+	}
+	return int(item.rank + s.agingRate*float64(s.now().Sub(s.epoch))), true
+}
+
+// AddTask queues the task, a task with an already queued
+// identifier replaces the queued one keeping its place among equals
 func (s *Scheduler) AddTask(task Task) {
-	// need to implement
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item, found := s.byID[task.Identifier]
+	if found {
+		s.heapOf(item).remove(item)
+	} else {
+		s.seq++
+		item = &scheduledTask{seq: s.seq}
+		s.byID[task.Identifier] = item
+	}
+
+	now := s.now()
+	item.task = task
+	item.readyAt = now
+	item.delayed = task.RunAt.After(now)
+	if item.delayed {
+		item.readyAt = task.RunAt
+	}
+	item.rank = s.rankOf(task.Priority, item.readyAt)
+	heap.Push(s.heapOf(item), item)
+
+	close(s.added)
+	s.added = make(chan struct{})
 }
 
-func (s *Scheduler) ChangeTaskPriority(taskID int, newPriority int) {
-	// need to implement
+// ChangeTaskPriority reports whether the task was found in the queue
+func (s *Scheduler) ChangeTaskPriority(taskID int, newPriority int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item, found := s.byID[taskID]
+	if !found {
+		return false
+	}
+
+	item.rank = s.rankOf(newPriority, item.readyAt)
+	heap.Fix(s.heapOf(item), item.index)
+	return true
+}
+
+// RemoveTask reports whether the task was found in the queue
+func (s *Scheduler) RemoveTask(taskID int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item, found := s.byID[taskID]
+	if !found {
+		return false
+	}
+
+	s.heapOf(item).remove(item)
+	delete(s.byID, taskID)
+	return true
 }
 
+// GetTask returns the ready task with the highest priority
+// or a zero Task if there is none
 func (s *Scheduler) GetTask() Task {
-	// need to implement
-	return Task{}
+	task, _ := s.TryGetTask()
+	return task
+}
+
+// TryGetTask returns the ready task with the highest priority
+// and reports whether there was one
+func (s *Scheduler) TryGetTask() (Task, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.popLocked()
+}
+
+// GetTaskContext waits until a task is ready or ctx is done
+func (s *Scheduler) GetTaskContext(ctx context.Context) (Task, error) {
+	var err error
+	for {
+		s.mutex.Lock()
+		task, found := s.popLocked()
+		added := s.added
+		var timer *time.Timer
+		if !found && s.delayed.Len() > 0 {
+			timer = time.NewTimer(s.delayed.items[0].task.RunAt.Sub(s.now()))
+		}
+		s.mutex.Unlock()
+
+		if found {
+			return task, nil
+		}
+
+		var wakeup <-chan time.Time // nil blocks forever when nothing is delayed
+		if timer != nil {
+			wakeup = timer.C
+		}
+
+		select {
+		case <-added:
+		case <-wakeup:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return Task{}, err
+		}
+	}
+}
+
+// Len returns the number of queued tasks including delayed ones
+func (s *Scheduler) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.byID)
+}
+
+func (s *Scheduler) heapOf(item *scheduledTask) *taskHeap {
+	if item.delayed {
+		return s.delayed
+	}
+	return s.ready
+}
+
+func (s *Scheduler) popLocked() (Task, bool) {
+	now := s.now()
+	for s.delayed.Len() > 0 && !s.delayed.items[0].task.RunAt.After(now) {
+		item := heap.Pop(s.delayed).(*scheduledTask)
+		item.delayed = false
+		heap.Push(s.ready, item)
+	}
+
+	if s.ready.Len() == 0 {
+		return Task{}, false
+	}
+
+	item := heap.Pop(s.ready).(*scheduledTask)
+	delete(s.byID, item.task.Identifier)
+	return item.task, true
 }
 
 func TestTrace(t *testing.T) {
@@ -61,3 +346,149 @@ func TestTrace(t *testing.T) {
 	task = scheduler.GetTask()
 	assert.Equal(t, task3, task)
 }
+
+func TestSchedulerFIFOAmongEqualPriorities(t *testing.T) {
+	scheduler := NewScheduler()
+	for id := 1; id <= 5; id++ {
+		scheduler.AddTask(Task{Identifier: id, Priority: 10})
+	}
+	scheduler.AddTask(Task{Identifier: 6, Priority: 20})
+
+	assert.True(t, scheduler.RemoveTask(3))
+	assert.False(t, scheduler.RemoveTask(3))
+	assert.False(t, scheduler.ChangeTaskPriority(3, 100))
+
+	var order []int
+	for scheduler.Len() > 0 {
+		order = append(order, scheduler.GetTask().Identifier)
+	}
+	assert.Equal(t, []int{6, 1, 2, 4, 5}, order)
+
+	_, found := scheduler.TryGetTask()
+	assert.False(t, found)
+	assert.Equal(t, Task{}, scheduler.GetTask())
+}
+
+func TestSchedulerGetTaskContext(t *testing.T) {
+	scheduler := NewScheduler()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err := scheduler.GetTaskContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	const producers, tasksPerProducer = 4, 250
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < tasksPerProducer; i++ {
+				id := p*tasksPerProducer + i
+				scheduler.AddTask(Task{Identifier: id, Priority: i})
+				if i%10 == 0 {
+					scheduler.ChangeTaskPriority(id, -i)
+				}
+			}
+		}()
+	}
+
+	var received atomic.Int32
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		for received.Load() < producers*tasksPerProducer {
+			if _, err := scheduler.GetTaskContext(context.Background()); err == nil {
+				received.Add(1)
+			}
+		}
+	}()
+
+	wg.Wait()
+	<-consumed
+	assert.Equal(t, int32(producers*tasksPerProducer), received.Load())
+	assert.Zero(t, scheduler.Len())
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestSchedulerDelayedTasks(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	scheduler := NewScheduler(WithClock(clock.Now))
+
+	delayed := Task{Identifier: 1, Priority: 100, RunAt: clock.now.Add(time.Minute)}
+	regular := Task{Identifier: 2, Priority: 1}
+	scheduler.AddTask(delayed)
+	scheduler.AddTask(regular)
+
+	assert.Equal(t, regular, scheduler.GetTask())
+	_, found := scheduler.TryGetTask()
+	assert.False(t, found)
+	assert.Equal(t, 1, scheduler.Len())
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, delayed, scheduler.GetTask())
+}
+
+func TestSchedulerDelayedTaskWakesConsumer(t *testing.T) {
+	scheduler := NewScheduler()
+	task := Task{Identifier: 1, RunAt: time.Now().Add(time.Millisecond * 100)}
+	scheduler.AddTask(task)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	received, err := scheduler.GetTaskContext(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, task, received)
+	assert.False(t, time.Now().Before(task.RunAt))
+}
+
+func TestSchedulerEarliestDeadlineFirst(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	scheduler := NewScheduler(WithClock(clock.Now), WithEarliestDeadlineFirst())
+
+	scheduler.AddTask(Task{Identifier: 1, Priority: 100})
+	scheduler.AddTask(Task{Identifier: 2, Priority: 1, Deadline: clock.now.Add(time.Hour)})
+	scheduler.AddTask(Task{Identifier: 3, Priority: 1, Deadline: clock.now.Add(time.Minute)})
+	scheduler.AddTask(Task{Identifier: 4, Priority: 200})
+
+	var order []int
+	for scheduler.Len() > 0 {
+		order = append(order, scheduler.GetTask().Identifier)
+	}
+	assert.Equal(t, []int{3, 2, 4, 1}, order)
+}
+
+func TestSchedulerAging(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	scheduler := NewScheduler(WithClock(clock.Now), WithAging(time.Second, 1))
+
+	scheduler.AddTask(Task{Identifier: 1, Priority: 1})
+	clock.Advance(time.Second * 10)
+	scheduler.AddTask(Task{Identifier: 2, Priority: 5})
+
+	priority, found := scheduler.EffectivePriority(1)
+	assert.True(t, found)
+	assert.Equal(t, 11, priority)
+	priority, _ = scheduler.EffectivePriority(2)
+	assert.Equal(t, 5, priority)
+
+	// the low priority task has waited long enough to overtake the newer one
+	assert.Equal(t, 1, scheduler.GetTask().Identifier)
+	assert.Equal(t, 2, scheduler.GetTask().Identifier)
+
+	scheduler.AddTask(Task{Identifier: 3, Priority: 1})
+	clock.Advance(time.Second * 3)
+	scheduler.AddTask(Task{Identifier: 4, Priority: 5})
+	assert.Equal(t, 4, scheduler.GetTask().Identifier)
+}
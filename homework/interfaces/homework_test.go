@@ -1,7 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -17,22 +27,662 @@ type MessageService struct {
 	NotEmptyStruct bool
 }
 
+var (
+	ErrServiceNotFound    = errors.New("service not found")
+	ErrScopeRequired      = errors.New("scoped service resolved outside of a scope")
+	ErrLifetimeMismatch   = errors.New("service depends on a shorter living service")
+	ErrInvalidConstructor = errors.New("invalid constructor")
+	ErrDependencyCycle    = errors.New("dependency cycle")
+	ErrUnexpectedType     = errors.New("service has an unexpected type")
+	ErrScopeClosed        = errors.New("scope is closed")
+)
+
+// ResolveError carries the chain of services that led to a failure
+type ResolveError struct {
+	Chain []serviceKey // from the requested service to the failed one
+	Err   error
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("resolve %s: %v", formatChain(e.Chain), e.Err)
+}
+
+func (e *ResolveError) Unwrap() error {
+	return e.Err
+}
+
+func formatChain(chain []serviceKey) string {
+	parts := make([]string, len(chain))
+	for idx, key := range chain {
+		parts[idx] = key.String()
+	}
+	return strings.Join(parts, " -> ")
+}
+
+type Lifetime int
+
+const (
+	Transient Lifetime = iota // a new instance for every resolution
+	Scoped                    // one instance per scope
+	Singleton                 // one instance per container
+)
+
+func (l Lifetime) String() string {
+	switch l {
+	case Singleton:
+		return "singleton"
+	case Scoped:
+		return "scoped"
+	default:
+		return "transient"
+	}
+}
+
+type serviceKey struct {
+	typ  reflect.Type
+	name string
+}
+
+func (k serviceKey) String() string {
+	if k.name == "" {
+		return k.typ.String()
+	}
+	return fmt.Sprintf("%s(%q)", k.typ, k.name)
+}
+
+type registration struct {
+	key       serviceKey
+	lifetime  Lifetime
+	construct func(r Resolver) (any, error)
+	deps      []serviceKey // known for reflected constructors only, closures hide their dependencies
+
+	mutex    sync.Mutex // guards the singleton instance, failed constructions are retried
+	built    bool
+	instance any
+}
+
+// Resolver is implemented by the container, its scopes and the value passed
+// to constructors, the latter has to be used to resolve dependencies
+type Resolver interface {
+	resolve(key serviceKey) (any, error)
+}
+
+// Starter is started by Container.Start after the services it depends on
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// Stopper is stopped by Container.Stop or Scope.Close before the services it depends on,
+// services implementing io.Closer instead are closed at the same moment
+type Stopper interface {
+	Stop(ctx context.Context) error
+}
+
+const defaultStopTimeout = time.Second * 5
+
+type ContainerOption func(*Container)
+
+// WithStopTimeout limits how long every single service may take to stop
+func WithStopTimeout(timeout time.Duration) ContainerOption {
+	return func(c *Container) {
+		c.lifecycle.stopTimeout = timeout
+	}
+}
+
 type Container struct {
-	// need to implement
+	mutex     sync.RWMutex
+	services  map[serviceKey]*registration
+	lifecycle lifecycle // singletons with Start, Stop or Close
+}
+
+func NewContainer(options ...ContainerOption) *Container {
+	c := &Container{
+		services:  make(map[serviceKey]*registration),
+		lifecycle: lifecycle{stopTimeout: defaultStopTimeout},
+	}
+	for idx := range options {
+		options[idx](c)
+	}
+	return c
+}
+
+// Start builds all singletons and starts the ones implementing Starter in
+// dependency order, if one of them fails the started ones are stopped again
+// and the singletons are discarded like by Stop
+func (c *Container) Start(ctx context.Context) error {
+	c.mutex.RLock()
+	var singletons []serviceKey
+	for key, reg := range c.services {
+		if reg.lifetime == Singleton {
+			singletons = append(singletons, key)
+		}
+	}
+	c.mutex.RUnlock()
+
+	sort.Slice(singletons, func(i, j int) bool { // keeps the start order stable between runs
+		return singletons[i].String() < singletons[j].String()
+	})
+	for _, key := range singletons {
+		if _, err := c.resolve(key); err != nil {
+			return errors.Join(err, c.Stop(ctx))
+		}
+	}
+
+	if err := c.lifecycle.start(ctx); err != nil {
+		c.discardSingletons()
+		return err
+	}
+	return nil
+}
+
+// Stop stops singletons in the reverse dependency order and returns all stop errors,
+// stopped singletons are discarded, so the next Start or Resolve builds new ones
+func (c *Container) Stop(ctx context.Context) error {
+	err := c.lifecycle.stop(ctx)
+	c.discardSingletons()
+	return err
+}
+
+func (c *Container) discardSingletons() {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for _, reg := range c.services {
+		if reg.lifetime == Singleton {
+			reg.mutex.Lock()
+			reg.instance, reg.built = nil, false
+			reg.mutex.Unlock()
+		}
+	}
+}
+
+// Register registers a constructor of T, a registration of the same type replaces the previous one
+func Register[T any](c *Container, constructor func(r Resolver) (T, error), lifetime Lifetime) {
+	RegisterNamed(c, "", constructor, lifetime)
+}
+
+// RegisterNamed registers one of several constructors of T told apart by name
+func RegisterNamed[T any](c *Container, name string, constructor func(r Resolver) (T, error), lifetime Lifetime) {
+	key := serviceKey{typ: reflect.TypeFor[T](), name: name}
+	_ = c.register(&registration{ // closures have no known dependencies to form a cycle
+		key:      key,
+		lifetime: lifetime,
+		construct: func(r Resolver) (any, error) {
+			return constructor(r)
+		},
+	})
+}
+
+// Resolve returns an instance of T, scoped services can only be resolved through a scope
+func Resolve[T any](r Resolver) (T, error) {
+	return ResolveNamed[T](r, "")
+}
+
+// ResolveNamed returns the zero T when the constructor returned a nil interface
+func ResolveNamed[T any](r Resolver, name string) (T, error) {
+	var zero T
+	key := serviceKey{typ: reflect.TypeFor[T](), name: name}
+	instance, err := r.resolve(key)
+	if err != nil || instance == nil {
+		return zero, err
+	}
+
+	value, ok := instance.(T)
+	if !ok {
+		return zero, &ResolveError{Chain: []serviceKey{key}, Err: fmt.Errorf("%w: %T", ErrUnexpectedType, instance)}
+	}
+	return value, nil
+}
+
+func (c *Container) register(reg *registration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	previous, replaced := c.services[reg.key]
+	c.services[reg.key] = reg
+
+	// the graph had no cycles before, so a new one has to pass through reg
+	if chain := c.findCycleLocked(reg.key, []serviceKey{reg.key}); chain != nil {
+		if replaced {
+			c.services[reg.key] = previous
+		} else {
+			delete(c.services, reg.key)
+		}
+		return fmt.Errorf("%w: %s", ErrDependencyCycle, formatChain(chain))
+	}
+	return nil
+}
+
+func (c *Container) findCycleLocked(target serviceKey, chain []serviceKey) []serviceKey {
+	reg, found := c.services[chain[len(chain)-1]]
+	if !found {
+		return nil
+	}
+
+	for _, dep := range reg.deps {
+		next := append(chain[:len(chain):len(chain)], dep)
+		if dep == target {
+			return next
+		}
+		if contains(chain, dep) {
+			continue // a cycle that does not involve target was reported when it appeared
+		}
+		if cycle := c.findCycleLocked(target, next); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// Provide registers a constructor whose parameters are resolved by type,
+// it has to return a service or a service and an error
+func (c *Container) Provide(constructor any, lifetime Lifetime) error {
+	out, construct, deps, err := reflectConstructor(constructor)
+	if err != nil {
+		return err
+	}
+
+	return c.register(&registration{
+		key:       serviceKey{typ: out},
+		lifetime:  lifetime,
+		construct: construct,
+		deps:      deps,
+	})
+}
+
+var errorType = reflect.TypeFor[error]()
+
+func reflectConstructor(constructor any) (reflect.Type, func(r Resolver) (any, error), []serviceKey, error) {
+	value := reflect.ValueOf(constructor)
+	if !value.IsValid() {
+		return nil, nil, nil, fmt.Errorf("%w: nil", ErrInvalidConstructor)
+	}
+	typ := value.Type()
+	if typ.Kind() != reflect.Func || value.IsNil() || typ.IsVariadic() || typ.NumOut() == 0 || typ.NumOut() > 2 ||
+		(typ.NumOut() == 2 && typ.Out(1) != errorType) {
+		return nil, nil, nil, fmt.Errorf("%w: %T, expected func(deps...) T or func(deps...) (T, error)", ErrInvalidConstructor, constructor)
+	}
+
+	deps := make([]serviceKey, typ.NumIn())
+	for idx := range deps {
+		deps[idx] = serviceKey{typ: typ.In(idx)}
+	}
+
+	construct := func(r Resolver) (any, error) {
+		args := make([]reflect.Value, len(deps))
+		for idx, dep := range deps {
+			arg, err := r.resolve(dep)
+			if err != nil {
+				return nil, err
+			}
+			args[idx] = reflect.ValueOf(arg)
+			if arg == nil { // a nil interface has to be passed as a typed zero value
+				args[idx] = reflect.Zero(dep.typ)
+			}
+		}
+
+		results := value.Call(args)
+		if len(results) == 2 && !results[1].IsNil() {
+			return nil, results[1].Interface().(error)
+		}
+		return results[0].Interface(), nil
+	}
+
+	return typ.Out(0), construct, deps, nil
+}
+
+// Validate checks the whole graph of reflected constructors: missing services,
+// cycles and singletons that capture scoped services
+func (c *Container) Validate() error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var errs []error
+	inCycle := make(map[serviceKey]bool) // a cycle is reported once, not by each of its members
+	for _, key := range c.sortedKeysLocked() {
+		reg := c.services[key]
+		for _, dep := range reg.deps {
+			if _, found := c.services[dep]; !found {
+				errs = append(errs, &ResolveError{Chain: []serviceKey{key, dep}, Err: ErrServiceNotFound})
+			}
+		}
+		if !inCycle[key] {
+			if chain := c.findCycleLocked(key, []serviceKey{key}); chain != nil {
+				for _, member := range chain {
+					inCycle[member] = true
+				}
+				errs = append(errs, fmt.Errorf("%w: %s", ErrDependencyCycle, formatChain(chain)))
+			}
+		}
+		if reg.lifetime == Singleton {
+			if chain := c.findCaptiveLocked([]serviceKey{key}); chain != nil {
+				errs = append(errs, &ResolveError{Chain: chain, Err: ErrLifetimeMismatch})
+			}
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func NewContainer() *Container {
-	// need to implement
-	return &Container{}
+// sortedKeysLocked keeps the order of reported errors stable between runs
+func (c *Container) sortedKeysLocked() []serviceKey {
+	keys := make([]serviceKey, 0, len(c.services))
+	for key := range c.services {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	return keys
+}
+
+// findCaptiveLocked looks for a scoped service reachable through transient ones,
+// dependencies of singletons are checked when these singletons are validated
+func (c *Container) findCaptiveLocked(chain []serviceKey) []serviceKey {
+	for _, dep := range c.services[chain[len(chain)-1]].deps {
+		reg, found := c.services[dep]
+		if !found || contains(chain, dep) {
+			continue
+		}
+
+		next := append(chain[:len(chain):len(chain)], dep)
+		switch reg.lifetime {
+		case Scoped:
+			return next
+		case Transient:
+			if captive := c.findCaptiveLocked(next); captive != nil {
+				return captive
+			}
+		}
+	}
+	return nil
 }
 
-func (c *Container) RegisterType(name string, constructor interface{}) {
-	// need to implement
+func contains(keys []serviceKey, key serviceKey) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Container) lookup(key serviceKey) (*registration, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	reg, found := c.services[key]
+	return reg, found
+}
+
+// legacyType is the key type of services registered by name with RegisterType
+var legacyType = reflect.TypeFor[interface{}]()
+
+// RegisterType registers a transient constructor by name, parameters
+// of the constructor are resolved by type like the ones passed to Provide
+func (c *Container) RegisterType(name string, constructor interface{}) error {
+	_, construct, deps, err := reflectConstructor(constructor)
+	if err != nil {
+		return err
+	}
+
+	key := serviceKey{typ: legacyType, name: name}
+	return c.register(&registration{key: key, lifetime: Transient, construct: construct, deps: deps})
 }
 
 func (c *Container) Resolve(name string) (interface{}, error) {
-	// need to implement
-	return nil, nil
+	return c.resolve(serviceKey{typ: legacyType, name: name})
+}
+
+func (c *Container) resolve(key serviceKey) (any, error) {
+	return (&resolution{container: c, owner: Transient}).resolve(key)
+}
+
+// NewScope creates a scope, scoped services resolved through it are built once per scope
+func (c *Container) NewScope() *Scope {
+	return &Scope{
+		container: c,
+		instances: make(map[serviceKey]any),
+		lifecycle: lifecycle{stopTimeout: c.lifecycle.stopTimeout},
+	}
+}
+
+type Scope struct {
+	container *Container
+	mutex     sync.Mutex
+	instances map[serviceKey]any
+	closed    bool
+	lifecycle lifecycle // scoped services with Stop or Close
+}
+
+// Close stops scoped services of the scope in the reverse dependency order,
+// the stopped instances are dropped and resolving from the scope fails afterwards
+func (s *Scope) Close(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closed = true
+	s.instances = nil
+	s.mutex.Unlock()
+
+	return s.lifecycle.stop(ctx)
+}
+
+func (s *Scope) resolve(key serviceKey) (any, error) {
+	s.mutex.Lock()
+	closed := s.closed
+	s.mutex.Unlock()
+	if closed {
+		return nil, &ResolveError{Chain: []serviceKey{key}, Err: ErrScopeClosed}
+	}
+	return (&resolution{container: s.container, scope: s, owner: Transient}).resolve(key)
+}
+
+// resolution is passed to constructors, it remembers the chain of services
+// being built to report cycles and the longest lifetime among them to catch
+// captive dependencies
+type resolution struct {
+	container *Container
+	scope     *Scope // nil while building singletons or resolving from the container
+	owner     Lifetime
+	chain     []serviceKey
+}
+
+func (r *resolution) resolve(key serviceKey) (any, error) {
+	chain := append(r.chain[:len(r.chain):len(r.chain)], key)
+	if contains(r.chain, key) {
+		return nil, &ResolveError{Chain: chain, Err: ErrDependencyCycle}
+	}
+
+	reg, found := r.container.lookup(key)
+	if !found {
+		return nil, &ResolveError{Chain: chain, Err: ErrServiceNotFound}
+	}
+
+	if reg.lifetime == Scoped && r.owner == Singleton {
+		return nil, &ResolveError{Chain: chain, Err: ErrLifetimeMismatch}
+	}
+
+	next := &resolution{container: r.container, scope: r.scope, owner: max(r.owner, reg.lifetime), chain: chain}
+	switch reg.lifetime {
+	case Singleton:
+		next.scope = nil
+		return reg.singleton(next, &r.container.lifecycle)
+	case Scoped:
+		if r.scope == nil {
+			return nil, &ResolveError{Chain: chain, Err: ErrScopeRequired}
+		}
+		return r.scope.instance(reg, next)
+	default:
+		return construct(reg, next)
+	}
+}
+
+func (reg *registration) singleton(r *resolution, lc *lifecycle) (any, error) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	if !reg.built {
+		instance, err := construct(reg, r)
+		if err != nil {
+			return nil, err
+		}
+		reg.instance, reg.built = instance, true
+		lc.track(reg.key, instance)
+	}
+	return reg.instance, nil
+}
+
+func (s *Scope) instance(reg *registration, r *resolution) (any, error) {
+	s.mutex.Lock()
+	instance, found := s.instances[reg.key]
+	closed := s.closed
+	s.mutex.Unlock()
+	if closed {
+		return nil, &ResolveError{Chain: r.chain, Err: ErrScopeClosed}
+	}
+	if found {
+		return instance, nil
+	}
+
+	instance, err := construct(reg, r)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed { // closed while the instance was being built
+		return nil, &ResolveError{Chain: r.chain, Err: ErrScopeClosed}
+	}
+	if existing, found := s.instances[reg.key]; found {
+		return existing, nil // another goroutine of the same scope was faster
+	}
+	s.instances[reg.key] = instance
+	s.lifecycle.track(reg.key, instance)
+	return instance, nil
+}
+
+type managedService struct {
+	key      serviceKey
+	instance any
+}
+
+// lifecycle remembers services in the order their construction finished,
+// dependencies are always built first, so it is a valid start order
+type lifecycle struct {
+	transition  sync.Mutex // serializes start and stop, track does not take it
+	mutex       sync.Mutex
+	services    []managedService
+	started     int // services[:started] went through Start
+	stopTimeout time.Duration
+}
+
+func (l *lifecycle) track(key serviceKey, instance any) {
+	switch instance.(type) {
+	case Starter, Stopper, io.Closer:
+	default:
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.services = append(l.services, managedService{key: key, instance: instance})
+}
+
+// start calls Start without holding the mutex, a service may resolve
+// singletons that are not built yet and get tracked while it starts.
+// When a service fails, only the ones started before it are stopped,
+// the rest is dropped without being stopped
+func (l *lifecycle) start(ctx context.Context) error {
+	l.transition.Lock()
+	defer l.transition.Unlock()
+
+	for {
+		l.mutex.Lock()
+		if l.started == len(l.services) {
+			l.mutex.Unlock()
+			return nil
+		}
+		service := l.services[l.started]
+		l.mutex.Unlock()
+
+		if starter, ok := service.instance.(Starter); ok {
+			if err := starter.Start(ctx); err != nil {
+				err = fmt.Errorf("start %s: %w", service.key, err)
+				return errors.Join(err, l.stopServices(ctx, l.take(true)))
+			}
+		}
+
+		l.mutex.Lock()
+		l.started++
+		l.mutex.Unlock()
+	}
+}
+
+func (l *lifecycle) stop(ctx context.Context) error {
+	l.transition.Lock()
+	defer l.transition.Unlock()
+
+	return l.stopServices(ctx, l.take(false))
+}
+
+// take forgets the tracked services and returns the ones to stop
+func (l *lifecycle) take(onlyStarted bool) []managedService {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	services := l.services
+	if onlyStarted {
+		services = services[:l.started]
+	}
+	l.services, l.started = nil, 0
+	return services
+}
+
+func (l *lifecycle) stopServices(ctx context.Context, services []managedService) error {
+	var errs []error
+	for idx := len(services) - 1; idx >= 0; idx-- {
+		if err := l.stopService(ctx, services[idx]); err != nil {
+			errs = append(errs, fmt.Errorf("stop %s: %w", services[idx].key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stopService does not wait for a service that ignores the context longer than the timeout
+func (l *lifecycle) stopService(ctx context.Context, service managedService) error {
+	ctx, cancel := context.WithTimeout(ctx, l.stopTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		switch instance := service.instance.(type) {
+		case Stopper:
+			done <- instance.Stop(ctx)
+		case io.Closer:
+			done <- instance.Close()
+		default:
+			done <- nil
+		}
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func construct(reg *registration, r *resolution) (any, error) {
+	instance, err := reg.construct(r)
+	if err != nil {
+		var resolveErr *ResolveError
+		if errors.As(err, &resolveErr) {
+			return nil, err // a dependency failed and already reported its chain
+		}
+		return nil, &ResolveError{Chain: r.chain, Err: err}
+	}
+	return instance, nil
 }
 
 func TestDIContainer(t *testing.T) {
@@ -61,3 +711,384 @@ func TestDIContainer(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, paymentService)
 }
+
+type Logger interface {
+	Log(message string)
+}
+
+type stdoutLogger struct{}
+
+func (stdoutLogger) Log(string) {}
+
+type RequestContext struct {
+	ID int
+}
+
+type Handler struct {
+	Request *RequestContext
+	Logger  Logger
+}
+
+func TestGenericDIContainer(t *testing.T) {
+	container := NewContainer()
+
+	var built atomic.Int32
+	Register(container, func(Resolver) (Logger, error) {
+		built.Add(1)
+		return stdoutLogger{}, nil
+	}, Singleton)
+	RegisterNamed(container, "audit", func(Resolver) (Logger, error) {
+		return &stdoutLogger{}, nil
+	}, Singleton)
+
+	var requests atomic.Int32
+	Register(container, func(Resolver) (*RequestContext, error) {
+		return &RequestContext{ID: int(requests.Add(1))}, nil
+	}, Scoped)
+	Register(container, func(r Resolver) (*Handler, error) {
+		request, err := Resolve[*RequestContext](r)
+		if err != nil {
+			return nil, err
+		}
+		logger, err := Resolve[Logger](r)
+		if err != nil {
+			return nil, err
+		}
+		return &Handler{Request: request, Logger: logger}, nil
+	}, Transient)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := Resolve[Logger](container)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), built.Load())
+
+	audit, err := ResolveNamed[Logger](container, "audit")
+	assert.NoError(t, err)
+	assert.IsType(t, &stdoutLogger{}, audit)
+
+	_, err = Resolve[*Handler](container)
+	assert.ErrorIs(t, err, ErrScopeRequired)
+
+	scope1, scope2 := container.NewScope(), container.NewScope()
+	handler1, err := Resolve[*Handler](scope1)
+	assert.NoError(t, err)
+	handler2, err := Resolve[*Handler](scope1)
+	assert.NoError(t, err)
+	handler3, err := Resolve[*Handler](scope2)
+	assert.NoError(t, err)
+
+	assert.False(t, handler1 == handler2)
+	assert.True(t, handler1.Request == handler2.Request)
+	assert.False(t, handler1.Request == handler3.Request)
+
+	_, err = Resolve[*MessageService](container)
+	assert.ErrorIs(t, err, ErrServiceNotFound)
+}
+
+func TestDIContainerNilAndMistypedInstances(t *testing.T) {
+	container := NewContainer()
+	Register(container, func(Resolver) (Logger, error) {
+		return nil, nil
+	}, Singleton)
+
+	logger, err := Resolve[Logger](container)
+	assert.NoError(t, err)
+	assert.Nil(t, logger)
+
+	assert.NoError(t, container.register(&registration{
+		key: serviceKey{typ: reflect.TypeFor[*UserService]()},
+		construct: func(Resolver) (any, error) {
+			return &MessageService{}, nil
+		},
+	}))
+	_, err = Resolve[*UserService](container)
+	assert.ErrorIs(t, err, ErrUnexpectedType)
+	assert.EqualError(t, err, "resolve *main.UserService: service has an unexpected type: *main.MessageService")
+}
+
+func TestDIContainerLifetimeMismatch(t *testing.T) {
+	container := NewContainer()
+	Register(container, func(Resolver) (*RequestContext, error) {
+		return &RequestContext{}, nil
+	}, Scoped)
+	Register(container, func(r Resolver) (*Handler, error) {
+		request, err := Resolve[*RequestContext](r)
+		return &Handler{Request: request}, err
+	}, Transient)
+	Register(container, func(r Resolver) (*UserService, error) {
+		_, err := Resolve[*Handler](r)
+		return &UserService{}, err
+	}, Singleton)
+
+	_, err := Resolve[*UserService](container.NewScope())
+	assert.ErrorIs(t, err, ErrLifetimeMismatch)
+}
+
+type Repository struct{}
+
+type Cache struct {
+	Repository *Repository
+}
+
+func TestDIContainerAutoWiring(t *testing.T) {
+	container := NewContainer()
+	assert.NoError(t, container.Provide(func() Logger { return stdoutLogger{} }, Singleton))
+	assert.NoError(t, container.Provide(func(logger Logger) *UserService {
+		return &UserService{NotEmptyStruct: logger != nil}
+	}, Singleton))
+	assert.NoError(t, container.Provide(func(users *UserService, logger Logger) (*MessageService, error) {
+		return &MessageService{NotEmptyStruct: users.NotEmptyStruct}, nil
+	}, Transient))
+	container.RegisterType("MessageService", func(messages *MessageService) interface{} {
+		return messages
+	})
+	assert.NoError(t, container.Validate())
+
+	messages, err := Resolve[*MessageService](container)
+	assert.NoError(t, err)
+	assert.True(t, messages.NotEmptyStruct)
+
+	legacy, err := container.Resolve("MessageService")
+	assert.NoError(t, err)
+	assert.IsType(t, &MessageService{}, legacy)
+
+	assert.ErrorIs(t, container.Provide(42, Singleton), ErrInvalidConstructor)
+	assert.ErrorIs(t, container.Provide(func() (int, int) { return 0, 0 }, Singleton), ErrInvalidConstructor)
+	assert.ErrorIs(t, container.Provide(nil, Singleton), ErrInvalidConstructor)
+	assert.ErrorIs(t, container.Provide((func() *Cache)(nil), Singleton), ErrInvalidConstructor)
+	assert.ErrorIs(t, container.RegisterType("Cache", nil), ErrInvalidConstructor)
+	_, err = container.Resolve("Cache")
+	assert.ErrorIs(t, err, ErrServiceNotFound) // rejected constructors are not registered
+}
+
+func TestDIContainerDependencyChain(t *testing.T) {
+	container := NewContainer()
+	assert.NoError(t, container.Provide(func(cache *Cache) *UserService { return &UserService{} }, Transient))
+	assert.NoError(t, container.Provide(func(repository *Repository) *Cache { return &Cache{repository} }, Transient))
+
+	_, err := Resolve[*UserService](container)
+	assert.ErrorIs(t, err, ErrServiceNotFound)
+	assert.EqualError(t, err, "resolve *main.UserService -> *main.Cache -> *main.Repository: service not found")
+	assert.ErrorIs(t, container.Validate(), ErrServiceNotFound)
+
+	assert.NoError(t, container.Provide(func() (*Repository, error) {
+		return nil, errors.New("connection refused")
+	}, Singleton))
+	_, err = Resolve[*UserService](container)
+	assert.EqualError(t, err, "resolve *main.UserService -> *main.Cache -> *main.Repository: connection refused")
+}
+
+func TestDIContainerCycles(t *testing.T) {
+	container := NewContainer()
+	assert.NoError(t, container.Provide(func(*Cache) *UserService { return &UserService{} }, Transient))
+	assert.NoError(t, container.Provide(func(*UserService) *Repository { return &Repository{} }, Transient))
+
+	err := container.Provide(func(*Repository) *Cache { return &Cache{} }, Transient)
+	assert.ErrorIs(t, err, ErrDependencyCycle)
+	assert.ErrorContains(t, err, "*main.Cache -> *main.Repository -> *main.UserService -> *main.Cache")
+
+	// closures hide their dependencies, such cycles are caught while resolving
+	Register(container, func(r Resolver) (*Cache, error) {
+		_, err := Resolve[*Repository](r)
+		return &Cache{}, err
+	}, Singleton)
+	_, err = Resolve[*Cache](container)
+	assert.ErrorIs(t, err, ErrDependencyCycle)
+
+	// Provide rejects cycles, a graph with one can only be assembled by hand
+	cyclic := NewContainer()
+	for _, reg := range []*registration{
+		{key: serviceKey{typ: reflect.TypeFor[*Cache]()}, deps: []serviceKey{{typ: reflect.TypeFor[*Repository]()}}},
+		{key: serviceKey{typ: reflect.TypeFor[*Repository]()}, deps: []serviceKey{{typ: reflect.TypeFor[*Cache]()}}},
+	} {
+		cyclic.services[reg.key] = reg
+	}
+	err = cyclic.Validate()
+	assert.EqualError(t, err, "dependency cycle: *main.Cache -> *main.Repository -> *main.Cache")
+}
+
+func TestDIContainerValidateLifetimes(t *testing.T) {
+	container := NewContainer()
+	assert.NoError(t, container.Provide(func() *RequestContext { return &RequestContext{} }, Scoped))
+	assert.NoError(t, container.Provide(func(request *RequestContext) *Handler { return &Handler{Request: request} }, Transient))
+	assert.NoError(t, container.Provide(func(*Handler) *UserService { return &UserService{} }, Singleton))
+
+	err := container.Validate()
+	assert.ErrorIs(t, err, ErrLifetimeMismatch)
+	assert.ErrorContains(t, err, "*main.UserService -> *main.Handler -> *main.RequestContext")
+}
+
+type journal struct {
+	mutex   sync.Mutex
+	entries []string
+}
+
+func (j *journal) record(entry string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.entries = append(j.entries, entry)
+}
+
+func (j *journal) take() []string {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entries := j.entries
+	j.entries = nil
+	return entries
+}
+
+// component records its lifecycle events into a shared journal
+type component struct {
+	name     string
+	journal  *journal
+	startErr error
+	stopErr  error
+	hang     bool
+}
+
+func (c *component) Start(context.Context) error {
+	c.journal.record("start " + c.name)
+	return c.startErr
+}
+
+func (c *component) Stop(ctx context.Context) error {
+	c.journal.record("stop " + c.name)
+	if c.hang {
+		time.Sleep(time.Second)
+	}
+	return c.stopErr
+}
+
+type Database struct{ component }
+type Broker struct{ component }
+type Server struct{ component }
+
+type Connection struct {
+	journal *journal
+}
+
+func (c *Connection) Close() error {
+	c.journal.record("close connection")
+	return nil
+}
+
+func TestDIContainerLifecycle(t *testing.T) {
+	events := &journal{}
+	container := NewContainer(WithStopTimeout(time.Millisecond * 100))
+
+	assert.NoError(t, container.Provide(func(db *Database, broker *Broker) *Server {
+		return &Server{component{name: "server", journal: events}}
+	}, Singleton))
+	assert.NoError(t, container.Provide(func(db *Database) *Broker {
+		return &Broker{component{name: "broker", journal: events, stopErr: errors.New("broker error"), hang: true}}
+	}, Singleton))
+	assert.NoError(t, container.Provide(func() *Database {
+		return &Database{component{name: "database", journal: events, stopErr: errors.New("database error")}}
+	}, Singleton))
+	assert.NoError(t, container.Provide(func() *Connection {
+		return &Connection{journal: events}
+	}, Scoped))
+
+	assert.NoError(t, container.Start(context.Background()))
+	assert.Equal(t, []string{"start database", "start broker", "start server"}, events.take())
+
+	scope := container.NewScope()
+	_, err := Resolve[*Connection](scope)
+	assert.NoError(t, err)
+	assert.NoError(t, scope.Close(context.Background()))
+	assert.Equal(t, []string{"close connection"}, events.take())
+
+	_, err = Resolve[*Connection](scope) // the closed connection is not handed out again
+	assert.ErrorIs(t, err, ErrScopeClosed)
+	_, err = Resolve[*Database](scope)
+	assert.ErrorIs(t, err, ErrScopeClosed)
+	assert.NoError(t, scope.Close(context.Background()))
+	assert.Empty(t, events.take())
+
+	err = container.Stop(context.Background())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "stop *main.Broker")
+	assert.ErrorContains(t, err, "database error")
+	assert.Equal(t, []string{"stop server", "stop broker", "stop database"}, events.take())
+}
+
+func TestDIContainerStartFailure(t *testing.T) {
+	events := &journal{}
+	container := NewContainer()
+
+	var attempts atomic.Int32
+	assert.NoError(t, container.Provide(func() *Database {
+		return &Database{component{name: "database", journal: events}}
+	}, Singleton))
+	assert.NoError(t, container.Provide(func(db *Database) *Broker {
+		var err error
+		if attempts.Add(1) == 1 {
+			err = errors.New("broker is down")
+		}
+		return &Broker{component{name: "broker", journal: events, startErr: err}}
+	}, Singleton))
+	assert.NoError(t, container.Provide(func(db *Database, broker *Broker) *Server {
+		return &Server{component{name: "server", journal: events}}
+	}, Singleton))
+
+	// the failed broker and the server that never started are not stopped
+	err := container.Start(context.Background())
+	assert.ErrorContains(t, err, "start *main.Broker: broker is down")
+	assert.Equal(t, []string{"start database", "start broker", "stop database"}, events.take())
+
+	// the container can be started again, singletons are built anew
+	assert.NoError(t, container.Start(context.Background()))
+	assert.Equal(t, []string{"start database", "start broker", "start server"}, events.take())
+	assert.NoError(t, container.Stop(context.Background()))
+	assert.Equal(t, []string{"stop server", "stop broker", "stop database"}, events.take())
+
+	assert.NoError(t, container.Start(context.Background()))
+	assert.Equal(t, []string{"start database", "start broker", "start server"}, events.take())
+	assert.Equal(t, int32(3), attempts.Load())
+	assert.NoError(t, container.Stop(context.Background()))
+}
+
+// lazyMailer registers and resolves its database only when it starts
+type lazyMailer struct {
+	component
+	container *Container
+}
+
+func (m *lazyMailer) Start(ctx context.Context) error {
+	Register(m.container, func(Resolver) (*Database, error) {
+		return &Database{component{name: "database", journal: m.journal}}, nil
+	}, Singleton)
+	if _, err := Resolve[*Database](m.container); err != nil {
+		return err
+	}
+	return m.component.Start(ctx)
+}
+
+func TestDIContainerStartResolvesSingletons(t *testing.T) {
+	events := &journal{}
+	container := NewContainer()
+	Register(container, func(Resolver) (*lazyMailer, error) {
+		return &lazyMailer{component{name: "mailer", journal: events}, container}, nil
+	}, Singleton)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- container.Start(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Start deadlocked")
+	}
+	// the database is tracked while the mailer starts and is started right after it
+	assert.Equal(t, []string{"start mailer", "start database"}, events.take())
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"cmp"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// go test -bench=. -benchmem homewrok_test.go skiplist_test.go bench_test.go
+
+// bstMap is the previous unbalanced version of OrderedMap kept as a baseline
+type bstMap[K cmp.Ordered, V any] struct {
+	root *bstNode[K, V]
+	size int
+}
+
+type bstNode[K cmp.Ordered, V any] struct {
+	key   K
+	value V
+	left  *bstNode[K, V]
+	right *bstNode[K, V]
+}
+
+func (m *bstMap[K, V]) Insert(key K, value V) {
+	link := &m.root
+	for *link != nil {
+		switch cmp.Compare(key, (*link).key) {
+		case less:
+			link = &(*link).left
+		case greater:
+			link = &(*link).right
+		default:
+			(*link).value = value
+			return
+		}
+	}
+	*link = &bstNode[K, V]{key: key, value: value}
+	m.size++
+}
+
+func (m *bstMap[K, V]) Contains(key K) bool {
+	node := m.root
+	for node != nil {
+		switch cmp.Compare(key, node.key) {
+		case less:
+			node = node.left
+		case greater:
+			node = node.right
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// sorted input makes the baseline a linked list, so every insert walks all previous keys
+const benchmarkSize = 10_000
+
+func sortedKeys() []int {
+	keys := make([]int, benchmarkSize)
+	for i := range keys {
+		keys[i] = i
+	}
+	return keys
+}
+
+func randomKeys() []int {
+	return rand.New(rand.NewSource(1)).Perm(benchmarkSize)
+}
+
+func BenchmarkInsertSortedBST(b *testing.B) {
+	keys := sortedKeys()
+	for i := 0; i < b.N; i++ {
+		var data bstMap[int, int]
+		for _, key := range keys {
+			data.Insert(key, key)
+		}
+	}
+}
+
+func BenchmarkInsertSortedAVL(b *testing.B) {
+	keys := sortedKeys()
+	for i := 0; i < b.N; i++ {
+		data := NewOrderedMap[int, int]()
+		for _, key := range keys {
+			data.Insert(key, key)
+		}
+	}
+}
+
+func BenchmarkInsertRandomBST(b *testing.B) {
+	keys := randomKeys()
+	for i := 0; i < b.N; i++ {
+		var data bstMap[int, int]
+		for _, key := range keys {
+			data.Insert(key, key)
+		}
+	}
+}
+
+func BenchmarkInsertRandomAVL(b *testing.B) {
+	keys := randomKeys()
+	for i := 0; i < b.N; i++ {
+		data := NewOrderedMap[int, int]()
+		for _, key := range keys {
+			data.Insert(key, key)
+		}
+	}
+}
+
+func BenchmarkContainsSortedBST(b *testing.B) {
+	var data bstMap[int, int]
+	for _, key := range sortedKeys() {
+		data.Insert(key, key)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data.Contains(i % benchmarkSize)
+	}
+}
+
+func BenchmarkContainsSortedAVL(b *testing.B) {
+	data := NewOrderedMap[int, int]()
+	for _, key := range sortedKeys() {
+		data.Insert(key, key)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data.Contains(i % benchmarkSize)
+	}
+}
+
+// lockedOrderedMap is the usual way to share OrderedMap between goroutines
+type lockedOrderedMap struct {
+	mutex sync.RWMutex
+	data  OrderedMap[int, int]
+}
+
+func (m *lockedOrderedMap) Get(key int) (int, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.data.Get(key)
+}
+
+func (m *lockedOrderedMap) Insert(key, value int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.data.Insert(key, value)
+}
+
+type concurrentMap interface {
+	Get(key int) (int, bool)
+	Insert(key, value int)
+}
+
+// benchmarkMixed runs the given percent of inserts among lookups from all procs
+func benchmarkMixed(b *testing.B, data concurrentMap, writePercent int) {
+	for _, key := range randomKeys() {
+		data.Insert(key, key)
+	}
+
+	var seed atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		random := rand.New(rand.NewSource(seed.Add(1)))
+		for pb.Next() {
+			key := random.Intn(benchmarkSize)
+			if random.Intn(100) < writePercent {
+				data.Insert(key, key)
+			} else {
+				data.Get(key)
+			}
+		}
+	})
+}
+
+func BenchmarkMixedReadHeavyLocked(b *testing.B) {
+	benchmarkMixed(b, &lockedOrderedMap{data: NewOrderedMap[int, int]()}, 10)
+}
+
+func BenchmarkMixedReadHeavySkipList(b *testing.B) {
+	benchmarkMixed(b, NewSkipList[int, int](), 10)
+}
+
+func BenchmarkMixedWriteHeavyLocked(b *testing.B) {
+	benchmarkMixed(b, &lockedOrderedMap{data: NewOrderedMap[int, int]()}, 50)
+}
+
+func BenchmarkMixedWriteHeavySkipList(b *testing.B) {
+	benchmarkMixed(b, NewSkipList[int, int](), 50)
+}
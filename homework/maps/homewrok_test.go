@@ -2,10 +2,18 @@ package main
 
 import (
 	"cmp"
+	"math"
+	"math/rand"
 	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
 )
 
 // go test -v homework_test.go
@@ -16,29 +24,120 @@ const (
 	greater = 1
 )
 
-type Node[K cmp.Ordered, V any] struct {
-	key   K
-	value V
-	left  *Node[K, V]
-	right *Node[K, V]
+// Node is a node of an AVL tree: heights of the subtrees
+// of every node differ by one at most, so the depth stays O(log n)
+type Node[K any, V any] struct {
+	key    K
+	value  V
+	left   *Node[K, V]
+	right  *Node[K, V]
+	height int
+	count  int // nodes in the subtree, used by Rank and Select
 }
 
-type OrderedMap[K cmp.Ordered, V any] struct {
+// tree holds the read-only part of the map shared with snapshots
+type tree[K any, V any] struct {
 	root *Node[K, V]
 	size int
 	cmp  func(x, y K) int
 }
 
+type OrderedMap[K any, V any] struct {
+	tree[K, V]
+	persistent bool
+	published  atomic.Pointer[Snapshot[K, V]]
+}
+
+// Snapshot is an immutable version of a persistent map, it is safe
+// to read from any number of goroutines while writers continue
+type Snapshot[K any, V any] struct {
+	tree[K, V]
+}
+
 func NewOrderedMap[K cmp.Ordered, V any]() OrderedMap[K, V] {
+	return NewOrderedMapFunc[K, V](cmp.Compare[K])
+}
+
+// NewOrderedMapFunc creates a map ordered by cmp, which returns a negative
+// number, zero or a positive number like cmp.Compare does
+func NewOrderedMapFunc[K any, V any](cmp func(a, b K) int) OrderedMap[K, V] {
 	return OrderedMap[K, V]{
-		root: nil,
-		size: 0,
-		cmp:  cmp.Compare[K],
+		tree: tree[K, V]{
+			root: nil,
+			size: 0,
+			cmp:  cmp,
+		},
 	}
 }
 
-func (m *OrderedMap[K, V]) Get(key K) (V, bool) {
-	if node := findNode(m.root, key, m.cmp); node != nil {
+// NewCollatedOrderedMap creates a map of strings sorted by the rules
+// of the given language, e.g. language.Russian puts "ё" right after "е"
+func NewCollatedOrderedMap[V any](tag language.Tag, options ...collate.Option) OrderedMap[string, V] {
+	return NewOrderedMapFunc[string, V](CollatedCompare(tag, options...))
+}
+
+// CollatedCompare compares strings by the rules of the given language and is safe
+// for concurrent use. A collator keeps internal buffers, so every comparison
+// takes its own one from a pool
+func CollatedCompare(tag language.Tag, options ...collate.Option) func(a, b string) int {
+	collators := sync.Pool{
+		New: func() any {
+			return collate.New(tag, options...)
+		},
+	}
+
+	return func(a, b string) int {
+		collator := collators.Get().(*collate.Collator)
+		defer collators.Put(collator)
+		return collator.CompareString(a, b)
+	}
+}
+
+// NewPersistentOrderedMap creates a map that never changes nodes in place:
+// every write copies the path from the root to the changed node and
+// publishes the new root, so Snapshot costs O(1). Writers still have
+// to be serialized by the caller, readers of snapshots need no locks
+func NewPersistentOrderedMap[K cmp.Ordered, V any]() *OrderedMap[K, V] {
+	return NewPersistentOrderedMapFunc[K, V](cmp.Compare[K])
+}
+
+// NewPersistentOrderedMapFunc is NewPersistentOrderedMap with a custom order,
+// cmp is called by snapshot readers concurrently, so it must be safe for that
+func NewPersistentOrderedMapFunc[K any, V any](cmp func(a, b K) int) *OrderedMap[K, V] {
+	m := &OrderedMap[K, V]{
+		tree:       tree[K, V]{cmp: cmp},
+		persistent: true,
+	}
+	m.publish()
+	return m
+}
+
+// Snapshot returns the latest published version of a persistent map
+func (m *OrderedMap[K, V]) Snapshot() *Snapshot[K, V] {
+	if !m.persistent {
+		panic("maps: snapshot of a non-persistent map")
+	}
+	return m.published.Load()
+}
+
+func (m *OrderedMap[K, V]) publish() {
+	if m.persistent {
+		m.published.Store(&Snapshot[K, V]{tree: m.tree})
+	}
+}
+
+// mutable returns the node itself for a regular map and its copy
+// for a persistent one, where nodes may be shared with snapshots
+func (m *OrderedMap[K, V]) mutable(node *Node[K, V]) *Node[K, V] {
+	if !m.persistent {
+		return node
+	}
+	clone := *node
+	return &clone
+}
+
+func (t *tree[K, V]) Get(key K) (V, bool) {
+	if node := findNode(t.root, key, t.cmp); node != nil {
 		return node.value, true
 	}
 
@@ -48,44 +147,49 @@ func (m *OrderedMap[K, V]) Get(key K) (V, bool) {
 
 func (m *OrderedMap[K, V]) Insert(key K, value V) {
 	m.root = m.insertRecursive(m.root, key, value)
+	m.publish()
 }
 
+// insertRecursive goes as deep as the tree is high, which is O(log n) after balancing
 func (m *OrderedMap[K, V]) insertRecursive(root *Node[K, V], key K, value V) *Node[K, V] {
 	if root == nil {
-		root = &Node[K, V]{key: key, value: value}
+		root = &Node[K, V]{key: key, value: value, height: 1, count: 1}
 		m.size++
 		return root
 	}
 
-	switch m.cmp(key, root.key) {
-	case less:
+	root = m.mutable(root)
+	switch order := m.cmp(key, root.key); {
+	case order < 0:
 		root.left = m.insertRecursive(root.left, key, value)
-	case greater:
+	case order > 0:
 		root.right = m.insertRecursive(root.right, key, value)
-	case equal:
+	default:
 		root.value = value
+		return root
 	}
 
-	return root
+	return m.rebalance(root)
 }
 
 func (m *OrderedMap[K, V]) Erase(key K) {
 	m.root = m.remove(m.root, key)
+	m.publish()
 }
 
-func (m *OrderedMap[K, V]) Contains(key K) bool {
-	if node := findNode(m.root, key, m.cmp); node != nil {
+func (t *tree[K, V]) Contains(key K) bool {
+	if node := findNode(t.root, key, t.cmp); node != nil {
 		return true
 	}
 	return false
 }
 
-func (m *OrderedMap[K, V]) Size() int {
-	return m.size
+func (t *tree[K, V]) Size() int {
+	return t.size
 }
 
-func (m *OrderedMap[K, V]) ForEach(action func(kye K, value V)) {
-	traverse(m.root, action)
+func (t *tree[K, V]) ForEach(action func(kye K, value V)) {
+	traverse(t.root, action)
 }
 
 func (m *OrderedMap[K, V]) remove(root *Node[K, V], key K) *Node[K, V] {
@@ -93,49 +197,119 @@ func (m *OrderedMap[K, V]) remove(root *Node[K, V], key K) *Node[K, V] {
 		return nil
 	}
 
-	switch m.cmp(key, root.key) {
-	case less:
+	root = m.mutable(root)
+	switch order := m.cmp(key, root.key); {
+	case order < 0:
 		root.left = m.remove(root.left, key)
-	case greater:
+	case order > 0:
 		root.right = m.remove(root.right, key)
-	case equal:
+	default:
+		m.size--
 		if root.left == nil {
-			m.size--
 			return root.right
 		} else if root.right == nil {
-			m.size--
 			return root.left
 		}
 
-		// find the min node of the right subtree
-		minNode := root.right
-		for minNode != nil && minNode.left != nil {
-			minNode = minNode.left
-		}
+		// the min node of the right subtree takes the place of the removed one
+		var minNode *Node[K, V]
+		root.right, minNode = m.removeMin(root.right)
+		minNode = m.mutable(minNode)
+		minNode.left, minNode.right = root.left, root.right
+		root = minNode
+	}
 
-		root.key = minNode.key
-		root.value = minNode.value
-		root.right = m.remove(root.right, minNode.key)
+	return m.rebalance(root)
+}
+
+func (m *OrderedMap[K, V]) removeMin(root *Node[K, V]) (*Node[K, V], *Node[K, V]) {
+	if root.left == nil {
+		return root.right, root
 	}
-	return root
+
+	var minNode *Node[K, V]
+	root = m.mutable(root)
+	root.left, minNode = m.removeMin(root.left)
+	return m.rebalance(root), minNode
 }
 
-func findNode[K cmp.Ordered, V any](root *Node[K, V], key K, cmp func(x, y K) int) *Node[K, V] {
-	if root == nil {
-		return nil
+func height[K any, V any](node *Node[K, V]) int {
+	if node == nil {
+		return 0
 	}
+	return node.height
+}
+
+func count[K any, V any](node *Node[K, V]) int {
+	if node == nil {
+		return 0
+	}
+	return node.count
+}
+
+func (n *Node[K, V]) update() {
+	n.height = 1 + max(height(n.left), height(n.right))
+	n.count = 1 + count(n.left) + count(n.right)
+}
 
-	switch cmp(key, root.key) {
-	case less:
-		return findNode[K, V](root.left, key, cmp)
-	case greater:
-		return findNode[K, V](root.right, key, cmp)
+// rotateRight lifts the left child over root: ((a pivot b) root c) -> (a pivot (b root c))
+func (m *OrderedMap[K, V]) rotateRight(root *Node[K, V]) *Node[K, V] {
+	root = m.mutable(root)
+	pivot := m.mutable(root.left)
+	root.left = pivot.right
+	pivot.right = root
+	root.update()
+	pivot.update()
+	return pivot
+}
+
+func (m *OrderedMap[K, V]) rotateLeft(root *Node[K, V]) *Node[K, V] {
+	root = m.mutable(root)
+	pivot := m.mutable(root.right)
+	root.right = pivot.left
+	pivot.left = root
+	root.update()
+	pivot.update()
+	return pivot
+}
+
+// rebalance restores the AVL invariant of a node whose subtrees
+// differ in height by two at most after a single insert or remove,
+// the root itself must already be mutable
+func (m *OrderedMap[K, V]) rebalance(root *Node[K, V]) *Node[K, V] {
+	root.update()
+
+	switch balance := height(root.left) - height(root.right); {
+	case balance > 1:
+		if height(root.left.left) < height(root.left.right) {
+			root.left = m.rotateLeft(root.left) // left-right case
+		}
+		return m.rotateRight(root)
+	case balance < -1:
+		if height(root.right.right) < height(root.right.left) {
+			root.right = m.rotateRight(root.right) // right-left case
+		}
+		return m.rotateLeft(root)
 	default:
 		return root
 	}
 }
 
-func traverse[K cmp.Ordered, V any](node *Node[K, V], action func(key K, value V)) {
+func findNode[K any, V any](root *Node[K, V], key K, cmp func(x, y K) int) *Node[K, V] {
+	for root != nil {
+		switch order := cmp(key, root.key); {
+		case order < 0:
+			root = root.left
+		case order > 0:
+			root = root.right
+		default:
+			return root
+		}
+	}
+	return nil
+}
+
+func traverse[K any, V any](node *Node[K, V], action func(key K, value V)) {
 	if node == nil {
 		return
 	}
@@ -144,6 +318,219 @@ func traverse[K cmp.Ordered, V any](node *Node[K, V], action func(key K, value V
 	traverse(node.right, action)
 }
 
+// Range calls action for keys in [from, to) in ascending order
+// until action returns false
+func (t *tree[K, V]) Range(from, to K, action func(key K, value V) bool) {
+	t.rangeRecursive(t.root, from, to, action)
+}
+
+func (t *tree[K, V]) rangeRecursive(node *Node[K, V], from, to K, action func(key K, value V) bool) bool {
+	if node == nil {
+		return true
+	}
+
+	afterFrom := t.cmp(node.key, from) >= 0
+	beforeTo := t.cmp(node.key, to) < 0
+	if afterFrom && !t.rangeRecursive(node.left, from, to, action) {
+		return false
+	}
+	if afterFrom && beforeTo && !action(node.key, node.value) {
+		return false
+	}
+	if beforeTo {
+		return t.rangeRecursive(node.right, from, to, action)
+	}
+	return true
+}
+
+// Floor returns the entry with the greatest key less than or equal to key
+func (t *tree[K, V]) Floor(key K) (K, V, bool) {
+	return entry(t.floorNode(key, true))
+}
+
+// Ceiling returns the entry with the smallest key greater than or equal to key
+func (t *tree[K, V]) Ceiling(key K) (K, V, bool) {
+	return entry(t.ceilingNode(key, true))
+}
+
+func (t *tree[K, V]) Min() (K, V, bool) {
+	node := t.root
+	for node != nil && node.left != nil {
+		node = node.left
+	}
+	return entry(node)
+}
+
+func (t *tree[K, V]) Max() (K, V, bool) {
+	node := t.root
+	for node != nil && node.right != nil {
+		node = node.right
+	}
+	return entry(node)
+}
+
+// Rank returns the number of keys less than key
+func (t *tree[K, V]) Rank(key K) int {
+	rank := 0
+	node := t.root
+	for node != nil {
+		switch order := t.cmp(key, node.key); {
+		case order < 0:
+			node = node.left
+		case order > 0:
+			rank += count(node.left) + 1
+			node = node.right
+		default:
+			return rank + count(node.left)
+		}
+	}
+	return rank
+}
+
+// Select returns the entry with the given zero-based position in key order
+func (t *tree[K, V]) Select(index int) (K, V, bool) {
+	if index < 0 || index >= t.size {
+		return entry[K, V](nil)
+	}
+
+	node := t.root
+	for {
+		switch leftCount := count(node.left); {
+		case index < leftCount:
+			node = node.left
+		case index > leftCount:
+			index -= leftCount + 1
+			node = node.right
+		default:
+			return entry(node)
+		}
+	}
+}
+
+// floorNode finds the greatest key below key, or equal to it if inclusive
+func (t *tree[K, V]) floorNode(key K, inclusive bool) *Node[K, V] {
+	var found *Node[K, V]
+	node := t.root
+	for node != nil {
+		if order := t.cmp(node.key, key); order < 0 || inclusive && order == 0 {
+			found, node = node, node.right
+		} else {
+			node = node.left
+		}
+	}
+	return found
+}
+
+// ceilingNode finds the smallest key above key, or equal to it if inclusive
+func (t *tree[K, V]) ceilingNode(key K, inclusive bool) *Node[K, V] {
+	var found *Node[K, V]
+	node := t.root
+	for node != nil {
+		if order := t.cmp(node.key, key); order > 0 || inclusive && order == 0 {
+			found, node = node, node.left
+		} else {
+			node = node.right
+		}
+	}
+	return found
+}
+
+func entry[K any, V any](node *Node[K, V]) (K, V, bool) {
+	if node == nil {
+		var key K
+		var value V
+		return key, value, false
+	}
+	return node.key, node.value, true
+}
+
+// Cursor walks the map in both directions, it remembers the current key
+// rather than a node, so it stays usable while the map is modified
+type Cursor[K any, V any] struct {
+	tree  *tree[K, V]
+	key   K
+	value V
+	valid bool
+}
+
+// Cursor returns a cursor positioned before the first entry, call First, Last or Seek to use it
+func (t *tree[K, V]) Cursor() *Cursor[K, V] {
+	return &Cursor[K, V]{tree: t}
+}
+
+func (c *Cursor[K, V]) First() bool {
+	return c.moveTo(c.tree.Min())
+}
+
+func (c *Cursor[K, V]) Last() bool {
+	return c.moveTo(c.tree.Max())
+}
+
+// Seek positions the cursor at the smallest key greater than or equal to key
+func (c *Cursor[K, V]) Seek(key K) bool {
+	return c.moveTo(c.tree.Ceiling(key))
+}
+
+func (c *Cursor[K, V]) Next() bool {
+	if !c.valid {
+		return false
+	}
+	return c.moveTo(entry(c.tree.ceilingNode(c.key, false)))
+}
+
+func (c *Cursor[K, V]) Prev() bool {
+	if !c.valid {
+		return false
+	}
+	return c.moveTo(entry(c.tree.floorNode(c.key, false)))
+}
+
+func (c *Cursor[K, V]) Valid() bool {
+	return c.valid
+}
+
+func (c *Cursor[K, V]) Key() K {
+	return c.key
+}
+
+func (c *Cursor[K, V]) Value() V {
+	return c.value
+}
+
+func (c *Cursor[K, V]) moveTo(key K, value V, found bool) bool {
+	c.key, c.value, c.valid = key, value, found
+	return found
+}
+
+// checkInvariants verifies ordering, cached heights and balance of the whole
+// tree and returns the number of nodes
+func checkInvariants[K any, V any](t *testing.T, tree tree[K, V]) int {
+	t.Helper()
+	return checkNodes(t, tree.root, nil, nil, tree.cmp)
+}
+
+func checkNodes[K any, V any](t *testing.T, node *Node[K, V], low, high *K, cmp func(x, y K) int) int {
+	t.Helper()
+	if node == nil {
+		return 0
+	}
+
+	if low != nil && cmp(node.key, *low) <= 0 || high != nil && cmp(node.key, *high) >= 0 {
+		t.Fatalf("key %v breaks the search order", node.key)
+	}
+	if expected := 1 + max(height(node.left), height(node.right)); node.height != expected {
+		t.Fatalf("node %v has height %d instead of %d", node.key, node.height, expected)
+	}
+	if balance := height(node.left) - height(node.right); balance < -1 || balance > 1 {
+		t.Fatalf("node %v is unbalanced by %d", node.key, balance)
+	}
+	if expected := 1 + count(node.left) + count(node.right); node.count != expected {
+		t.Fatalf("node %v has count %d instead of %d", node.key, node.count, expected)
+	}
+
+	return 1 + checkNodes(t, node.left, low, &node.key, cmp) + checkNodes(t, node.right, &node.key, high, cmp)
+}
+
 func TestOrderedMap(t *testing.T) {
 	data := NewOrderedMap[int, int]()
 	assert.Zero(t, data.Size())
@@ -188,3 +575,293 @@ func TestOrderedMap(t *testing.T) {
 
 	assert.True(t, reflect.DeepEqual(expectedKeys, keys))
 }
+
+func TestOrderedMapBalance(t *testing.T) {
+	const count = 100_000
+	data := NewOrderedMap[int, int]()
+	for i := 0; i < count; i++ {
+		data.Insert(i, i) // monotonic keys turn a plain BST into a list
+	}
+
+	assert.Equal(t, count, checkInvariants(t, data.tree))
+	assert.Equal(t, count, data.Size())
+	assert.LessOrEqual(t, float64(data.root.height), 1.45*math.Log2(count+2))
+
+	for i := 0; i < count; i += 2 {
+		data.Erase(i)
+	}
+	assert.Equal(t, count/2, checkInvariants(t, data.tree))
+	assert.Equal(t, count/2, data.Size())
+}
+
+func TestOrderedMapRandomized(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	data := NewOrderedMap[int, int]()
+	reference := make(map[int]int)
+
+	for i := 0; i < 20_000; i++ {
+		key := random.Intn(1000)
+		if random.Intn(3) == 0 {
+			data.Erase(key)
+			delete(reference, key)
+		} else {
+			data.Insert(key, i)
+			reference[key] = i
+		}
+	}
+
+	assert.Equal(t, len(reference), checkInvariants(t, data.tree))
+	assert.Equal(t, len(reference), data.Size())
+	for key, expected := range reference {
+		value, found := data.Get(key)
+		assert.True(t, found)
+		assert.Equal(t, expected, value)
+	}
+}
+
+func TestOrderedMapQueries(t *testing.T) {
+	data := NewOrderedMap[int, string]()
+	for _, key := range []int{50, 10, 40, 20, 30} {
+		data.Insert(key, strconv.Itoa(key))
+	}
+
+	var keys []int
+	data.Range(15, 45, func(key int, _ string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []int{20, 30, 40}, keys)
+
+	keys = nil
+	data.Range(0, 100, func(key int, _ string) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	})
+	assert.Equal(t, []int{10, 20}, keys)
+
+	key, value, found := data.Floor(35)
+	assert.True(t, found)
+	assert.Equal(t, 30, key)
+	assert.Equal(t, "30", value)
+	key, _, _ = data.Floor(30)
+	assert.Equal(t, 30, key)
+	_, _, found = data.Floor(5)
+	assert.False(t, found)
+
+	key, _, found = data.Ceiling(35)
+	assert.True(t, found)
+	assert.Equal(t, 40, key)
+	_, _, found = data.Ceiling(55)
+	assert.False(t, found)
+
+	key, _, _ = data.Min()
+	assert.Equal(t, 10, key)
+	key, _, _ = data.Max()
+	assert.Equal(t, 50, key)
+
+	assert.Equal(t, 0, data.Rank(10))
+	assert.Equal(t, 2, data.Rank(25))
+	assert.Equal(t, 2, data.Rank(30))
+	assert.Equal(t, 5, data.Rank(60))
+
+	for index, expected := range []int{10, 20, 30, 40, 50} {
+		key, _, found = data.Select(index)
+		assert.True(t, found)
+		assert.Equal(t, expected, key)
+	}
+	_, _, found = data.Select(5)
+	assert.False(t, found)
+
+	empty := NewOrderedMap[int, int]()
+	_, _, found = empty.Min()
+	assert.False(t, found)
+}
+
+func TestOrderedMapCursor(t *testing.T) {
+	data := NewOrderedMap[int, int]()
+	for key := 0; key < 100; key += 10 {
+		data.Insert(key, key*key)
+	}
+
+	cursor := data.Cursor()
+	assert.False(t, cursor.Valid())
+	assert.False(t, cursor.Next())
+
+	// a page of three keys starting at 35
+	var page []int
+	for ok := cursor.Seek(35); ok; ok = cursor.Next() {
+		if page = append(page, cursor.Key()); len(page) == 3 {
+			break
+		}
+	}
+	assert.Equal(t, []int{40, 50, 60}, page)
+	assert.Equal(t, 3600, cursor.Value())
+
+	data.Erase(50)
+	assert.True(t, cursor.Prev())
+	assert.Equal(t, 40, cursor.Key())
+
+	var backwards []int
+	for ok := cursor.Last(); ok; ok = cursor.Prev() {
+		backwards = append(backwards, cursor.Key())
+	}
+	assert.Equal(t, []int{90, 80, 70, 60, 40, 30, 20, 10, 0}, backwards)
+	assert.False(t, cursor.Valid())
+
+	assert.True(t, cursor.First())
+	assert.Equal(t, 0, cursor.Key())
+	assert.False(t, cursor.Seek(91))
+}
+
+func TestOrderedMapSnapshot(t *testing.T) {
+	data := NewPersistentOrderedMap[int, int]()
+	for i := 0; i < 1000; i++ {
+		data.Insert(i, i)
+	}
+
+	snapshot := data.Snapshot()
+	for i := 0; i < 1000; i += 2 {
+		data.Erase(i)
+	}
+	data.Insert(1, -1)
+	data.Insert(5000, 5000)
+
+	assert.Equal(t, 1000, snapshot.Size())
+	assert.Equal(t, 1000, checkInvariants(t, snapshot.tree))
+	value, found := snapshot.Get(1)
+	assert.True(t, found)
+	assert.Equal(t, 1, value)
+	assert.True(t, snapshot.Contains(0))
+	assert.False(t, snapshot.Contains(5000))
+
+	latest := data.Snapshot()
+	assert.Equal(t, 501, latest.Size())
+	assert.Equal(t, 501, checkInvariants(t, latest.tree))
+	value, _ = latest.Get(1)
+	assert.Equal(t, -1, value)
+	assert.False(t, latest.Contains(0))
+
+	assert.Panics(t, func() {
+		regular := NewOrderedMap[int, int]()
+		regular.Snapshot()
+	})
+}
+
+func TestOrderedMapSnapshotConcurrentReaders(t *testing.T) {
+	const count = 5000
+	data := NewPersistentOrderedMap[int, int]()
+
+	var wg sync.WaitGroup
+	var done atomic.Bool
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				snapshot := data.Snapshot()
+				// keys are inserted in order, so every version holds exactly [0, size)
+				expected := 0
+				snapshot.ForEach(func(key, value int) {
+					assert.Equal(t, expected, key)
+					expected++
+				})
+				assert.Equal(t, snapshot.Size(), expected)
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		data.Insert(i, i)
+	}
+	done.Store(true)
+	wg.Wait()
+
+	assert.Equal(t, count, checkInvariants(t, data.Snapshot().tree))
+}
+
+type version struct {
+	major, minor int
+}
+
+func compareVersions(a, b version) int {
+	return cmp.Or(cmp.Compare(a.major, b.major), cmp.Compare(a.minor, b.minor))
+}
+
+func TestOrderedMapFunc(t *testing.T) {
+	versions := NewOrderedMapFunc[version, string](compareVersions)
+	versions.Insert(version{1, 10}, "c")
+	versions.Insert(version{0, 9}, "a")
+	versions.Insert(version{1, 2}, "b")
+	versions.Insert(version{1, 2}, "b2")
+	versions.Insert(version{2, 0}, "d")
+
+	var values []string
+	versions.ForEach(func(_ version, value string) {
+		values = append(values, value)
+	})
+	assert.Equal(t, []string{"a", "b2", "c", "d"}, values)
+	assert.Equal(t, 4, checkInvariants(t, versions.tree))
+
+	key, _, found := versions.Floor(version{1, 5})
+	assert.True(t, found)
+	assert.Equal(t, version{1, 2}, key)
+
+	// time.Time must not be compared with ==, monotonic readings and locations differ
+	base := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	events := NewOrderedMapFunc[time.Time, string](time.Time.Compare)
+	events.Insert(base.Add(time.Hour), "later")
+	events.Insert(base, "now")
+	events.Insert(base.In(time.FixedZone("UTC+3", 3*60*60)), "same instant")
+
+	assert.Equal(t, 2, events.Size())
+	value, found := events.Get(base)
+	assert.True(t, found)
+	assert.Equal(t, "same instant", value)
+}
+
+func TestCollatedOrderedMap(t *testing.T) {
+	names := NewCollatedOrderedMap[int](language.Russian)
+	for index, name := range []string{"Яна", "Ёжик", "борис", "Алла", "Жанна", "Евгений", "Борис"} {
+		names.Insert(name, index)
+	}
+
+	var keys []string
+	names.ForEach(func(name string, _ int) {
+		keys = append(keys, name)
+	})
+	// byte order would put "Ё" before "А" and capitals before lowercase letters
+	assert.Equal(t, []string{"Алла", "борис", "Борис", "Евгений", "Ёжик", "Жанна", "Яна"}, keys)
+
+	folded := NewCollatedOrderedMap[int](language.Russian, collate.IgnoreCase)
+	folded.Insert("борис", 1)
+	folded.Insert("Борис", 2)
+	assert.Equal(t, 1, folded.Size())
+}
+
+func TestCollatedOrderedMapConcurrentReaders(t *testing.T) {
+	names := NewPersistentOrderedMapFunc[string, int](CollatedCompare(language.Russian))
+	for index := 0; index < 100; index++ {
+		names.Insert("имя "+strconv.Itoa(index), index)
+	}
+	snapshot := names.Snapshot()
+
+	var wg sync.WaitGroup
+	for reader := 0; reader < 8; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := 0; index < 100; index++ {
+				value, found := snapshot.Get("имя " + strconv.Itoa(index))
+				assert.True(t, found)
+				assert.Equal(t, index, value)
+			}
+		}()
+	}
+
+	// the writer compares keys with the same function at the same time
+	for index := 100; index < 200; index++ {
+		names.Insert("имя "+strconv.Itoa(index), index)
+	}
+	wg.Wait()
+	assert.Equal(t, 200, names.Size())
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"cmp"
+	"math/bits"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -race skiplist_test.go homewrok_test.go
+
+// skipListMaxLevel is enough for about 2^24 keys with the 1/2 promotion probability
+const skipListMaxLevel = 24
+
+// skipNode is linked into the levels below its height, it becomes visible
+// to readers once linked is set and logically removed once marked is set
+type skipNode[K any, V any] struct {
+	key    K
+	value  atomic.Pointer[V]
+	next   []atomic.Pointer[skipNode[K, V]]
+	mutex  sync.Mutex
+	marked atomic.Bool
+	linked atomic.Bool
+}
+
+// SkipList is a concurrent ordered map: readers never take locks,
+// writers lock only the predecessors of the changed node, so writes
+// to different parts of the list do not contend with each other
+type SkipList[K any, V any] struct {
+	head *skipNode[K, V]
+	size atomic.Int64
+	cmp  func(x, y K) int
+}
+
+func NewSkipList[K cmp.Ordered, V any]() *SkipList[K, V] {
+	return NewSkipListFunc[K, V](cmp.Compare[K])
+}
+
+// NewSkipListFunc creates a skip list ordered by cmp, it must be safe for concurrent use
+func NewSkipListFunc[K any, V any](cmp func(a, b K) int) *SkipList[K, V] {
+	return &SkipList[K, V]{
+		head: &skipNode[K, V]{next: make([]atomic.Pointer[skipNode[K, V]], skipListMaxLevel)},
+		cmp:  cmp,
+	}
+}
+
+func (s *SkipList[K, V]) Get(key K) (V, bool) {
+	pred := s.head
+	for level := skipListMaxLevel - 1; level >= 0; level-- {
+		node := pred.next[level].Load()
+		for node != nil && s.cmp(node.key, key) < 0 {
+			pred, node = node, node.next[level].Load()
+		}
+		if node != nil && s.cmp(node.key, key) == 0 {
+			if node.linked.Load() && !node.marked.Load() {
+				return *node.value.Load(), true
+			}
+			break
+		}
+	}
+
+	var zero V
+	return zero, false
+}
+
+func (s *SkipList[K, V]) Contains(key K) bool {
+	_, found := s.Get(key)
+	return found
+}
+
+// Insert adds the key or replaces the value of an existing one
+func (s *SkipList[K, V]) Insert(key K, value V) {
+	height := randomHeight()
+	var preds, succs [skipListMaxLevel]*skipNode[K, V]
+	for {
+		if level := s.find(key, &preds, &succs); level >= 0 {
+			node := succs[level]
+			if node.marked.Load() {
+				continue // the node is being removed, wait until it is unlinked
+			}
+			for !node.linked.Load() {
+				runtime.Gosched() // another writer is still linking the node
+			}
+			node.value.Store(&value)
+			return
+		}
+
+		locked, valid := lockPredecessors(&preds, &succs, height)
+		for level := 0; valid && level < height; level++ {
+			valid = succs[level] == nil || !succs[level].marked.Load()
+		}
+		if !valid {
+			unlockPredecessors(&preds, locked)
+			continue
+		}
+
+		node := &skipNode[K, V]{key: key, next: make([]atomic.Pointer[skipNode[K, V]], height)}
+		node.value.Store(&value)
+		for level := 0; level < height; level++ {
+			node.next[level].Store(succs[level])
+		}
+		for level := 0; level < height; level++ {
+			preds[level].next[level].Store(node)
+		}
+		node.linked.Store(true)
+
+		unlockPredecessors(&preds, locked)
+		s.size.Add(1)
+		return
+	}
+}
+
+func (s *SkipList[K, V]) Erase(key K) {
+	var preds, succs [skipListMaxLevel]*skipNode[K, V]
+	var victim *skipNode[K, V]
+	for {
+		level := s.find(key, &preds, &succs)
+		if victim == nil {
+			if level < 0 {
+				return
+			}
+
+			victim = succs[level]
+			// a node found below its top level is either not linked yet or already being unlinked
+			if !victim.linked.Load() || victim.marked.Load() || len(victim.next)-1 != level {
+				return
+			}
+
+			victim.mutex.Lock()
+			if victim.marked.Load() {
+				victim.mutex.Unlock()
+				return
+			}
+			victim.marked.Store(true) // from now on the key is absent for readers
+		}
+
+		for idx := range succs[:len(victim.next)] {
+			succs[idx] = victim
+		}
+		locked, valid := lockPredecessors(&preds, &succs, len(victim.next))
+		if !valid {
+			unlockPredecessors(&preds, locked)
+			continue
+		}
+
+		for level := len(victim.next) - 1; level >= 0; level-- {
+			preds[level].next[level].Store(victim.next[level].Load())
+		}
+		victim.mutex.Unlock()
+
+		unlockPredecessors(&preds, locked)
+		s.size.Add(-1)
+		return
+	}
+}
+
+func (s *SkipList[K, V]) Size() int {
+	return int(s.size.Load())
+}
+
+// ForEach visits keys in ascending order, concurrent writes may or may not
+// be observed, but every key is visited once at most
+func (s *SkipList[K, V]) ForEach(action func(key K, value V)) {
+	for node := s.head.next[0].Load(); node != nil; node = node.next[0].Load() {
+		if node.linked.Load() && !node.marked.Load() {
+			action(node.key, *node.value.Load())
+		}
+	}
+}
+
+// Range calls action for keys in [from, to) in ascending order
+// until action returns false, it is as consistent as ForEach
+func (s *SkipList[K, V]) Range(from, to K, action func(key K, value V) bool) {
+	pred := s.head
+	for level := skipListMaxLevel - 1; level >= 0; level-- {
+		node := pred.next[level].Load()
+		for node != nil && s.cmp(node.key, from) < 0 {
+			pred, node = node, node.next[level].Load()
+		}
+	}
+
+	for node := pred.next[0].Load(); node != nil && s.cmp(node.key, to) < 0; node = node.next[0].Load() {
+		if node.linked.Load() && !node.marked.Load() && !action(node.key, *node.value.Load()) {
+			return
+		}
+	}
+}
+
+// find fills the nearest nodes around key on every level and returns
+// the highest level where the key was met or -1
+func (s *SkipList[K, V]) find(key K, preds, succs *[skipListMaxLevel]*skipNode[K, V]) int {
+	found := -1
+	pred := s.head
+	for level := skipListMaxLevel - 1; level >= 0; level-- {
+		node := pred.next[level].Load()
+		for node != nil && s.cmp(node.key, key) < 0 {
+			pred, node = node, node.next[level].Load()
+		}
+		if found < 0 && node != nil && s.cmp(node.key, key) == 0 {
+			found = level
+		}
+		preds[level], succs[level] = pred, node
+	}
+	return found
+}
+
+// lockPredecessors locks the distinct predecessors of the levels below height and
+// checks that nothing changed between them and succs since find, it returns the
+// highest locked level, which must be passed to unlockPredecessors in any case
+func lockPredecessors[K any, V any](preds, succs *[skipListMaxLevel]*skipNode[K, V], height int) (int, bool) {
+	locked := -1
+	for level := 0; level < height; level++ {
+		pred := preds[level]
+		if level == 0 || pred != preds[level-1] {
+			pred.mutex.Lock()
+		}
+		locked = level
+
+		if pred.marked.Load() || pred.next[level].Load() != succs[level] {
+			return locked, false
+		}
+	}
+	return locked, true
+}
+
+func unlockPredecessors[K any, V any](preds *[skipListMaxLevel]*skipNode[K, V], locked int) {
+	for level := 0; level <= locked; level++ {
+		if level == 0 || preds[level] != preds[level-1] {
+			preds[level].mutex.Unlock()
+		}
+	}
+}
+
+// randomHeight returns h with the probability 1/2^h
+func randomHeight() int {
+	return bits.TrailingZeros64(rand.Uint64()|1<<(skipListMaxLevel-1)) + 1
+}
+
+func TestSkipList(t *testing.T) {
+	data := NewSkipList[int, int]()
+	assert.Zero(t, data.Size())
+
+	for _, key := range []int{10, 5, 15, 2, 4, 12, 14} {
+		data.Insert(key, key)
+	}
+	data.Insert(4, 40)
+
+	assert.Equal(t, 7, data.Size())
+	value, found := data.Get(4)
+	assert.True(t, found)
+	assert.Equal(t, 40, value)
+	assert.False(t, data.Contains(3))
+
+	var keys []int
+	data.ForEach(func(key, _ int) {
+		keys = append(keys, key)
+	})
+	assert.Equal(t, []int{2, 4, 5, 10, 12, 14, 15}, keys)
+
+	data.Erase(15)
+	data.Erase(2)
+	data.Erase(3)
+	assert.Equal(t, 5, data.Size())
+	assert.False(t, data.Contains(15))
+
+	keys = nil
+	data.Range(5, 14, func(key, _ int) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []int{5, 10, 12}, keys)
+
+	keys = nil
+	data.Range(0, 100, func(key, _ int) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	})
+	assert.Equal(t, []int{4, 5}, keys)
+}
+
+func TestSkipListConcurrentWriters(t *testing.T) {
+	const writers = 8
+	const keysPerWriter = 2000
+	data := NewSkipList[int, int]()
+
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for writer := 0; writer < writers; writer++ {
+		go func() {
+			defer wg.Done()
+			// writers interleave their keys, so they fight for the same predecessors
+			for i := 0; i < keysPerWriter; i++ {
+				data.Insert(i*writers+writer, writer)
+			}
+			for i := 0; i < keysPerWriter; i += 2 {
+				data.Erase(i*writers + writer)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, writers*keysPerWriter/2, data.Size())
+	previous, visited := -1, 0
+	data.ForEach(func(key, value int) {
+		assert.Greater(t, key, previous)
+		assert.Equal(t, key%writers, value)
+		assert.Equal(t, 1, key/writers%2, "key %d must have been erased", key)
+		previous = key
+		visited++
+	})
+	assert.Equal(t, data.Size(), visited)
+}
+
+func TestSkipListScanDuringWrites(t *testing.T) {
+	const count = 5000
+	data := NewSkipList[int, int]()
+	for key := 0; key < count; key += 2 {
+		data.Insert(key, key)
+	}
+
+	var done atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for !done.Load() {
+			previous, evens := -1, 0
+			data.Range(0, count, func(key, value int) bool {
+				assert.Greater(t, key, previous)
+				assert.Equal(t, key, value)
+				if key%2 == 0 {
+					evens++
+				}
+				previous = key
+				return true
+			})
+			assert.Equal(t, count/2, evens) // even keys are never touched by the writer
+		}
+	}()
+
+	for round := 0; round < 3; round++ {
+		for key := 1; key < count; key += 2 {
+			data.Insert(key, key)
+		}
+		for key := 1; key < count; key += 2 {
+			data.Erase(key)
+		}
+	}
+	done.Store(true)
+	wg.Wait()
+
+	assert.Equal(t, count/2, data.Size())
+}
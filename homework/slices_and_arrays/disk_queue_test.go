@@ -0,0 +1,732 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// go test -v disk_queue_test.go
+
+// SyncPolicy decides when written data is forced to the disk
+type SyncPolicy int
+
+const (
+	SyncAlways   SyncPolicy = iota // after every Push and Ack, nothing acknowledged is lost
+	SyncPeriodic                   // once per interval in the background, a crash loses up to the last interval
+	SyncNever                      // leaves flushing to the OS
+)
+
+var (
+	ErrQueueEmpty   = errors.New("disk queue: empty")
+	ErrQueueClosed  = errors.New("disk queue: closed")
+	ErrCorruptQueue = errors.New("disk queue: corrupt segment")
+)
+
+const (
+	segmentSuffix      = ".seg"
+	offsetFileName     = "consumer.offset"
+	recordHeaderSize   = 8 // length and checksum, both little endian uint32
+	offsetRecordSize   = 12
+	defaultSegmentSize = 64 << 20
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type DiskQueueOption func(*DiskQueue)
+
+// WithSegmentSize sets the size after which a new segment file is started,
+// a record is never split, so a segment may be larger by one record
+func WithSegmentSize(size int64) DiskQueueOption {
+	return func(q *DiskQueue) {
+		q.segmentSize = size
+	}
+}
+
+func WithSyncPolicy(policy SyncPolicy) DiskQueueOption {
+	return func(q *DiskQueue) {
+		q.syncPolicy = policy
+	}
+}
+
+// WithSyncInterval sets the interval for SyncPeriodic
+func WithSyncInterval(interval time.Duration) DiskQueueOption {
+	return func(q *DiskQueue) {
+		q.syncInterval = interval
+	}
+}
+
+// segment is a file named after the index of its first record
+type segment struct {
+	base  uint64
+	count uint64
+	size  int64
+	path  string
+}
+
+// DiskQueue is a FIFO queue of byte records kept in append-only segment files.
+// Every record is stored as its length, a CRC-32C of the length and the payload,
+// and the payload. The consumer position lives in a separate file, a lost or
+// torn position makes the queue start from the oldest kept record again, so
+// records are delivered at least once
+type DiskQueue struct {
+	mutex    sync.Mutex
+	dir      string
+	segments []*segment // the oldest first, the last one is open for writing
+	writer   *os.File
+	reader   *os.File // the first segment
+	offsets  *os.File
+	readPos  int64  // position of the head record in the first segment
+	head     uint64 // index of the oldest record not acknowledged yet
+	tail     uint64 // index of the next pushed record
+	closed   bool
+
+	segmentSize  int64
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+	lastSync     time.Time
+	dirty        bool          // written since the last sync
+	stopFlusher  chan struct{} // closed by Close, stops the SyncPeriodic flusher
+}
+
+// OpenDiskQueue opens the queue in dir creating it when needed,
+// a torn record at the end of the last segment is cut off
+func OpenDiskQueue(dir string, options ...DiskQueueOption) (*DiskQueue, error) {
+	q := &DiskQueue{
+		dir:          dir,
+		segmentSize:  defaultSegmentSize,
+		syncPolicy:   SyncAlways,
+		syncInterval: time.Second,
+		lastSync:     time.Now(),
+	}
+	for idx := range options {
+		options[idx](q)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := q.recover(); err != nil {
+		_ = q.closeFiles()
+		return nil, err
+	}
+	if q.syncPolicy == SyncPeriodic && q.syncInterval > 0 {
+		q.stopFlusher = make(chan struct{})
+		go q.flushPeriodically()
+	}
+	return q, nil
+}
+
+func (q *DiskQueue) Push(data []byte) error {
+	if len(data) > math.MaxUint32-recordHeaderSize {
+		return fmt.Errorf("disk queue: record of %d bytes is too large", len(data))
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	last := q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+recordHeaderSize+int64(len(data)) > q.segmentSize {
+		if err := q.roll(); err != nil {
+			return err
+		}
+		last = q.segments[len(q.segments)-1]
+	}
+
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(record, uint32(len(data)))
+	copy(record[recordHeaderSize:], data)
+	binary.LittleEndian.PutUint32(record[4:], checksum(record[:4], data))
+
+	if _, err := q.writer.Write(record); err != nil {
+		_ = q.writer.Truncate(last.size) // do not leave a partial record behind
+		return err
+	}
+	last.size += int64(len(record))
+	last.count++
+	q.tail++
+
+	return q.maybeSync(q.writer)
+}
+
+// Peek returns the oldest record without removing it
+func (q *DiskQueue) Peek() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	if q.head == q.tail {
+		return nil, ErrQueueEmpty
+	}
+
+	data, _, err := readRecord(q.reader, q.readPos, q.segments[0].size)
+	return data, err
+}
+
+// Ack removes the oldest record, segments are deleted once all their records are acknowledged
+func (q *DiskQueue) Ack() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if q.head == q.tail {
+		return ErrQueueEmpty
+	}
+
+	_, size, err := readRecord(q.reader, q.readPos, q.segments[0].size)
+	if err != nil {
+		return err
+	}
+	q.readPos += size
+	q.head++
+
+	if err := q.storeOffset(); err != nil {
+		return err
+	}
+
+	first := q.segments[0]
+	if len(q.segments) > 1 && q.head == first.base+first.count {
+		return q.dropFirstSegment()
+	}
+	return nil
+}
+
+func (q *DiskQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return int(q.tail - q.head)
+}
+
+// Sync forces written records and the consumer position to the disk
+func (q *DiskQueue) Sync() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+	return q.sync()
+}
+
+func (q *DiskQueue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	if q.stopFlusher != nil {
+		close(q.stopFlusher)
+	}
+
+	var err error
+	if q.syncPolicy != SyncNever {
+		err = q.sync()
+	}
+	return errors.Join(err, q.closeFiles())
+}
+
+func (q *DiskQueue) recover() error {
+	segments, err := q.loadSegments()
+	if err != nil {
+		return err
+	}
+
+	q.offsets, err = os.OpenFile(filepath.Join(q.dir, offsetFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	head, stored := q.loadOffset()
+
+	if len(segments) == 0 {
+		segments = append(segments, &segment{base: head, path: q.segmentPath(head)})
+		if err := q.createSegment(segments[0].path); err != nil {
+			return err
+		}
+	}
+	q.segments = segments
+
+	last := segments[len(segments)-1]
+	q.tail = last.base + last.count
+	first := segments[0]
+	if !stored || head < first.base || head > q.tail {
+		head = first.base // the position is unknown, deliver everything again
+	}
+	q.head = head
+
+	// a crash between storing the position and deleting a segment leaves consumed segments behind
+	for len(q.segments) > 1 && q.head >= q.segments[0].base+q.segments[0].count {
+		if err := os.Remove(q.segments[0].path); err != nil {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+
+	if q.writer, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return err
+	}
+	if err := q.openReader(); err != nil {
+		return err
+	}
+	for idx := q.segments[0].base; idx < q.head; idx++ {
+		_, size, err := readRecord(q.reader, q.readPos, q.segments[0].size)
+		if err != nil {
+			return err
+		}
+		q.readPos += size
+	}
+	return q.storeOffset()
+}
+
+// loadSegments checks every record of every segment, it truncates
+// the last segment after its last valid record and fails on anything else
+func (q *DiskQueue) loadSegments() ([]*segment, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unexpected file %s", ErrCorruptQueue, name)
+		}
+		segments = append(segments, &segment{base: base, path: filepath.Join(q.dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].base < segments[j].base
+	})
+
+	for idx, current := range segments {
+		if idx > 0 && current.base != segments[idx-1].base+segments[idx-1].count {
+			return nil, fmt.Errorf("%w: %s does not continue the previous segment", ErrCorruptQueue, current.path)
+		}
+
+		complete, err := scanSegment(current)
+		if err != nil {
+			return nil, err
+		}
+		if !complete {
+			if idx != len(segments)-1 {
+				return nil, fmt.Errorf("%w: invalid record in %s at %d", ErrCorruptQueue, current.path, current.size)
+			}
+			if err := os.Truncate(current.path, current.size); err != nil { // the torn tail of the last write
+				return nil, err
+			}
+		}
+	}
+	return segments, nil
+}
+
+// scanSegment counts valid records and stops at the first invalid one,
+// it reports whether the whole file was valid
+func scanSegment(current *segment) (bool, error) {
+	file, err := os.Open(current.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	for current.size < info.Size() {
+		_, size, err := readRecord(file, current.size, info.Size())
+		if errors.Is(err, ErrCorruptQueue) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		current.size += size
+		current.count++
+	}
+	return true, nil
+}
+
+// readRecord returns the payload and the whole size of the record at position,
+// the record must end before limit, so a garbage length is never allocated
+func readRecord(file *os.File, position, limit int64) ([]byte, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := file.ReadAt(header[:], position); err != nil {
+		return nil, 0, corruptOr(err)
+	}
+
+	length := int64(binary.LittleEndian.Uint32(header[:]))
+	if position+recordHeaderSize+length > limit {
+		return nil, 0, fmt.Errorf("%w: record at %d ends past the segment", ErrCorruptQueue, position)
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, position+recordHeaderSize); err != nil {
+		return nil, 0, corruptOr(err)
+	}
+	if checksum(header[:4], data) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, 0, fmt.Errorf("%w: checksum mismatch at %d", ErrCorruptQueue, position)
+	}
+	return data, recordHeaderSize + int64(len(data)), nil
+}
+
+// corruptOr turns a short read into a corruption, a record must never end past the file
+func corruptOr(err error) error {
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: truncated record", ErrCorruptQueue)
+	}
+	return err
+}
+
+// checksum covers the length as well, otherwise zeroes left
+// by a crash would look like valid empty records
+func checksum(length, data []byte) uint32 {
+	return crc32.Update(crc32.Checksum(length, castagnoli), castagnoli, data)
+}
+
+func (q *DiskQueue) loadOffset() (uint64, bool) {
+	var record [offsetRecordSize]byte
+	if _, err := q.offsets.ReadAt(record[:], 0); err != nil {
+		return 0, false
+	}
+	if crc32.Checksum(record[:8], castagnoli) != binary.LittleEndian.Uint32(record[8:]) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(record[:8]), true
+}
+
+// storeOffset overwrites the position in place, a torn write
+// is caught by the checksum when the queue is opened again
+func (q *DiskQueue) storeOffset() error {
+	var record [offsetRecordSize]byte
+	binary.LittleEndian.PutUint64(record[:8], q.head)
+	binary.LittleEndian.PutUint32(record[8:], crc32.Checksum(record[:8], castagnoli))
+	if _, err := q.offsets.WriteAt(record[:], 0); err != nil {
+		return err
+	}
+	return q.maybeSync(q.offsets)
+}
+
+func (q *DiskQueue) roll() error {
+	if q.syncPolicy != SyncNever {
+		if err := q.writer.Sync(); err != nil { // the next segment must never survive a crash without this one
+			return err
+		}
+	}
+
+	next := &segment{base: q.tail, path: q.segmentPath(q.tail)}
+	if err := q.createSegment(next.path); err != nil {
+		return err
+	}
+	writer, err := os.OpenFile(next.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_ = q.writer.Close() // the reader has its own handle of the first segment
+	q.writer = writer
+	q.segments = append(q.segments, next)
+
+	// Ack keeps the only segment even when it is consumed, it can go now
+	first := q.segments[0]
+	if q.head == first.base+first.count {
+		return q.dropFirstSegment()
+	}
+	return nil
+}
+
+func (q *DiskQueue) dropFirstSegment() error {
+	first := q.segments[0]
+	q.segments = q.segments[1:]
+	_ = q.reader.Close()
+	q.reader = nil
+	q.readPos = 0
+
+	if err := os.Remove(first.path); err != nil {
+		return err
+	}
+	if err := q.openReader(); err != nil {
+		return err
+	}
+	if q.syncPolicy == SyncAlways {
+		return syncDir(q.dir)
+	}
+	return nil
+}
+
+func (q *DiskQueue) openReader() error {
+	reader, err := os.Open(q.segments[0].path)
+	if err != nil {
+		return err
+	}
+	q.reader = reader
+	return nil
+}
+
+func (q *DiskQueue) createSegment(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if q.syncPolicy == SyncAlways {
+		return syncDir(q.dir)
+	}
+	return nil
+}
+
+func (q *DiskQueue) segmentPath(base uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", base, segmentSuffix))
+}
+
+func (q *DiskQueue) maybeSync(file *os.File) error {
+	switch q.syncPolicy {
+	case SyncAlways:
+		return file.Sync()
+	case SyncPeriodic:
+		if time.Since(q.lastSync) >= q.syncInterval {
+			return q.sync()
+		}
+		q.dirty = true
+	}
+	return nil
+}
+
+// flushPeriodically syncs what was written since the last sync,
+// so data does not stay unsynced when writes stop
+func (q *DiskQueue) flushPeriodically() {
+	ticker := time.NewTicker(q.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.mutex.Lock()
+			if !q.closed && q.dirty {
+				_ = q.sync() // dirty stays set, so the next tick retries
+			}
+			q.mutex.Unlock()
+		case <-q.stopFlusher:
+			return
+		}
+	}
+}
+
+func (q *DiskQueue) sync() error {
+	q.lastSync = time.Now()
+	if err := errors.Join(q.writer.Sync(), q.offsets.Sync()); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+func (q *DiskQueue) closeFiles() error {
+	var errs []error
+	for _, file := range []*os.File{q.writer, q.reader, q.offsets} {
+		if file != nil {
+			errs = append(errs, file.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func pushAll(t *testing.T, queue *DiskQueue, records ...string) {
+	t.Helper()
+	for _, record := range records {
+		require.NoError(t, queue.Push([]byte(record)))
+	}
+}
+
+func popAll(t *testing.T, queue *DiskQueue) []string {
+	t.Helper()
+	var records []string
+	for {
+		data, err := queue.Peek()
+		if errors.Is(err, ErrQueueEmpty) {
+			return records
+		}
+		require.NoError(t, err)
+		require.NoError(t, queue.Ack())
+		records = append(records, string(data))
+	}
+}
+
+func TestDiskQueue(t *testing.T) {
+	queue, err := OpenDiskQueue(t.TempDir())
+	require.NoError(t, err)
+	defer queue.Close()
+
+	_, err = queue.Peek()
+	assert.ErrorIs(t, err, ErrQueueEmpty)
+	assert.ErrorIs(t, queue.Ack(), ErrQueueEmpty)
+
+	pushAll(t, queue, "first", "", "third")
+	assert.Equal(t, 3, queue.Len())
+
+	data, err := queue.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+	data, _ = queue.Peek()
+	assert.Equal(t, "first", string(data)) // Peek does not consume
+
+	assert.Equal(t, []string{"first", "", "third"}, popAll(t, queue))
+	assert.Zero(t, queue.Len())
+
+	require.NoError(t, queue.Close())
+	assert.ErrorIs(t, queue.Push(nil), ErrQueueClosed)
+}
+
+func TestDiskQueueReopen(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := OpenDiskQueue(dir, WithSegmentSize(32))
+	require.NoError(t, err)
+	pushAll(t, queue, "one", "two", "three", "four", "five")
+	require.NoError(t, queue.Ack())
+	require.NoError(t, queue.Ack())
+	require.NoError(t, queue.Close())
+
+	queue, err = OpenDiskQueue(dir, WithSegmentSize(32))
+	require.NoError(t, err)
+	defer queue.Close()
+
+	assert.Equal(t, 3, queue.Len())
+	pushAll(t, queue, "six")
+	assert.Equal(t, []string{"three", "four", "five", "six"}, popAll(t, queue))
+
+	// consumed segments are deleted, only the one open for writing stays
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	assert.Len(t, segments, 1)
+}
+
+func TestDiskQueueTornTail(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := OpenDiskQueue(dir)
+	require.NoError(t, err)
+	pushAll(t, queue, "kept", "torn")
+	require.NoError(t, queue.Close())
+
+	// cut the last record in the middle and add the zeroes a crash may leave
+	path := queue.segments[0].path
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-2))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = file.Write(make([]byte, 16))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	queue, err = OpenDiskQueue(dir)
+	require.NoError(t, err)
+	defer queue.Close()
+
+	assert.Equal(t, 1, queue.Len())
+	pushAll(t, queue, "after")
+	assert.Equal(t, []string{"kept", "after"}, popAll(t, queue))
+}
+
+func TestDiskQueueCorruption(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := OpenDiskQueue(dir, WithSegmentSize(16))
+	require.NoError(t, err)
+	pushAll(t, queue, "first record", "second record")
+	require.NoError(t, queue.Close())
+
+	// a damaged record in a sealed segment cannot be a torn write, so it is not cut off silently
+	path := queue.segments[0].path
+	file, err := os.OpenFile(path, os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte("X"), recordHeaderSize)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	_, err = OpenDiskQueue(dir)
+	assert.ErrorIs(t, err, ErrCorruptQueue)
+}
+
+func TestDiskQueueLostOffset(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := OpenDiskQueue(dir, WithSyncPolicy(SyncPeriodic), WithSyncInterval(time.Hour))
+	require.NoError(t, err)
+	pushAll(t, queue, "a", "b")
+	require.NoError(t, queue.Ack())
+	require.NoError(t, queue.Close())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, offsetFileName), []byte("garbage"), 0o644))
+
+	queue, err = OpenDiskQueue(dir)
+	require.NoError(t, err)
+	defer queue.Close()
+	assert.Equal(t, []string{"a", "b"}, popAll(t, queue)) // at least once
+}
+
+func TestDiskQueueConsumedOnlySegment(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := OpenDiskQueue(dir, WithSegmentSize(16))
+	require.NoError(t, err)
+	defer queue.Close()
+
+	pushAll(t, queue, "aaaa")
+	require.NoError(t, queue.Ack())
+	pushAll(t, queue, "twelve bytes")
+
+	data, err := queue.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "twelve bytes", string(data))
+	assert.Equal(t, []string{"twelve bytes"}, popAll(t, queue))
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	assert.Len(t, segments, 1)
+}
+
+func TestDiskQueuePeriodicFlush(t *testing.T) {
+	queue, err := OpenDiskQueue(t.TempDir(), WithSyncPolicy(SyncPeriodic), WithSyncInterval(time.Millisecond*10))
+	require.NoError(t, err)
+	defer queue.Close()
+
+	pushAll(t, queue, "a", "b")
+
+	// nothing is pushed after that, the flusher syncs on its own
+	require.Eventually(t, func() bool {
+		queue.mutex.Lock()
+		defer queue.mutex.Unlock()
+		return !queue.dirty
+	}, time.Second, time.Millisecond*10)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// go test -v homework_test.go flight_recorder_test.go
+
+// Event is a single record of the flight recorder, Seq orders
+// events of different components relative to each other
+type Event struct {
+	Seq     uint64         `json:"seq"`
+	Time    time.Time      `json:"time"`
+	Kind    string         `json:"kind"`
+	Message string         `json:"message"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+// Dump is what the recorder writes: the latest events of every component, oldest first
+type Dump struct {
+	Reason     string             `json:"reason"`
+	DumpedAt   time.Time          `json:"dumped_at"`
+	Components map[string][]Event `json:"components"`
+}
+
+type RecorderOption func(*FlightRecorder)
+
+// WithDumpOutput sets where dumps on panic and on signals are written, os.Stderr by default
+func WithDumpOutput(output io.Writer) RecorderOption {
+	return func(r *FlightRecorder) {
+		r.output = output
+	}
+}
+
+// FlightRecorder keeps the last events of every component in memory,
+// so the context of a crash can be dumped when it happens
+type FlightRecorder struct {
+	capacity   int
+	output     io.Writer
+	sequence   atomic.Uint64
+	mutex      sync.RWMutex
+	components map[string]*ComponentRecorder
+}
+
+// ComponentRecorder records events of one component, components
+// have separate locks, so they do not slow each other down
+type ComponentRecorder struct {
+	recorder *FlightRecorder
+	mutex    sync.Mutex
+	events   CircularQueue[Event]
+}
+
+// NewFlightRecorder creates a recorder keeping capacity events per component
+func NewFlightRecorder(capacity int, options ...RecorderOption) *FlightRecorder {
+	r := &FlightRecorder{
+		capacity:   capacity,
+		output:     os.Stderr,
+		components: make(map[string]*ComponentRecorder),
+	}
+	for idx := range options {
+		options[idx](r)
+	}
+	return r
+}
+
+// Component returns the recorder of the named component, it is
+// meant to be taken once and kept by the component
+func (r *FlightRecorder) Component(name string) *ComponentRecorder {
+	r.mutex.RLock()
+	component, found := r.components[name]
+	r.mutex.RUnlock()
+	if found {
+		return component
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if component, found = r.components[name]; !found {
+		component = &ComponentRecorder{
+			recorder: r,
+			events:   NewCircularQueueWithMode[Event](r.capacity, Overwriting),
+		}
+		r.components[name] = component
+	}
+	return component
+}
+
+// Record adds an event, the oldest one is dropped when the ring is full.
+// The fields map is copied, the caller may keep changing it
+func (c *ComponentRecorder) Record(kind, message string, fields map[string]any) {
+	event := Event{
+		Time:    time.Now(),
+		Kind:    kind,
+		Message: message,
+		Fields:  maps.Clone(fields),
+	}
+
+	c.mutex.Lock()
+	event.Seq = c.recorder.sequence.Add(1) // under the lock, so the ring stays ordered by Seq
+	c.events.Push(event)
+	c.mutex.Unlock()
+}
+
+func (c *ComponentRecorder) RecordError(err error, fields map[string]any) {
+	c.Record("error", err.Error(), fields)
+}
+
+func (c *ComponentRecorder) snapshot() []Event {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.events.Values()
+}
+
+// Snapshot copies the recorded events, writers are blocked for one component at a time only
+func (r *FlightRecorder) Snapshot(reason string) Dump {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	dump := Dump{
+		Reason:     reason,
+		DumpedAt:   time.Now(),
+		Components: make(map[string][]Event, len(r.components)),
+	}
+	for name, component := range r.components {
+		dump.Components[name] = component.snapshot()
+	}
+	return dump
+}
+
+// encodedDump is a Dump with every event encoded on its own
+type encodedDump struct {
+	Reason     string                       `json:"reason"`
+	DumpedAt   time.Time                    `json:"dumped_at"`
+	Components map[string][]json.RawMessage `json:"components"`
+}
+
+// Dump writes the snapshot as JSON, an event with fields that cannot be
+// encoded is written without them, so it does not cost the rest of the dump
+func (r *FlightRecorder) Dump(output io.Writer, reason string) error {
+	snapshot := r.Snapshot(reason)
+	dump := encodedDump{
+		Reason:     snapshot.Reason,
+		DumpedAt:   snapshot.DumpedAt,
+		Components: make(map[string][]json.RawMessage, len(snapshot.Components)),
+	}
+	for name, events := range snapshot.Components {
+		encoded := make([]json.RawMessage, len(events))
+		for idx := range events {
+			encoded[idx] = encodeEvent(events[idx])
+		}
+		dump.Components[name] = encoded
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dump)
+}
+
+func encodeEvent(event Event) json.RawMessage {
+	data, err := json.Marshal(event)
+	if err != nil {
+		event.Fields = map[string]any{"encoding_error": err.Error()}
+		data, _ = json.Marshal(event) // only strings are left in the fields
+	}
+	return data
+}
+
+// DumpOnPanic must be deferred directly, it dumps the events
+// and panics again with the same value, a failed dump is logged
+func (r *FlightRecorder) DumpOnPanic() {
+	if value := recover(); value != nil {
+		if err := r.Dump(r.output, fmt.Sprintf("panic: %v", value)); err != nil {
+			log.Printf("flight recorder: dump on panic: %v", err)
+		}
+		panic(value)
+	}
+}
+
+// DumpOnSignal dumps the events every time one of the signals arrives,
+// SIGQUIT when none are given. The default reaction to the signals,
+// such as the goroutine dump and exit on SIGQUIT, is replaced until stop is called
+func (r *FlightRecorder) DumpOnSignal(signals ...os.Signal) (stop func()) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGQUIT}
+	}
+
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case sig := <-received:
+				if err := r.Dump(r.output, "signal: "+sig.String()); err != nil {
+					log.Printf("flight recorder: dump on %s: %v", sig, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(received)
+			close(done)
+			<-finished
+		})
+	}
+}
+
+// ServeHTTP writes the dump, so the recorder can be mounted as a debug handler.
+// The dump is buffered first, an error can still change the status then
+func (r *FlightRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buffer bytes.Buffer
+	if err := r.Dump(&buffer, "http: "+req.URL.Path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(buffer.Bytes())
+}
+
+// syncBuffer lets the test read what the signal goroutine writes
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(data []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(data)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return bytes.Clone(b.buffer.Bytes())
+}
+
+func decodeDump(t *testing.T, data []byte) Dump {
+	t.Helper()
+	var dump Dump
+	require.NoError(t, json.Unmarshal(data, &dump))
+	return dump
+}
+
+func TestFlightRecorder(t *testing.T) {
+	recorder := NewFlightRecorder(3)
+	worker := recorder.Component("worker")
+	scheduler := recorder.Component("scheduler")
+	assert.Same(t, worker, recorder.Component("worker"))
+
+	for idx := 1; idx <= 5; idx++ {
+		worker.Record("task", fmt.Sprintf("task %d started", idx), map[string]any{"task": idx})
+	}
+	scheduler.RecordError(fmt.Errorf("queue is full"), nil)
+
+	dump := recorder.Snapshot("test")
+	assert.Equal(t, "test", dump.Reason)
+	require.Len(t, dump.Components["worker"], 3)
+	assert.Equal(t, "task 3 started", dump.Components["worker"][0].Message)
+	assert.Equal(t, "task 5 started", dump.Components["worker"][2].Message)
+	assert.Equal(t, uint64(6), dump.Components["scheduler"][0].Seq)
+	assert.Equal(t, "error", dump.Components["scheduler"][0].Kind)
+}
+
+func TestFlightRecorderFields(t *testing.T) {
+	recorder := NewFlightRecorder(10)
+	worker := recorder.Component("worker")
+
+	fields := map[string]any{"task": 1}
+	worker.Record("task", "started", fields)
+	fields["task"] = 2 // the caller reuses its map
+	worker.Record("task", "broken", map[string]any{"task": 3, "callback": func() {}})
+	worker.Record("task", "finished", fields)
+
+	var output bytes.Buffer
+	require.NoError(t, recorder.Dump(&output, "test"))
+	dump := decodeDump(t, output.Bytes())
+	require.Len(t, dump.Components["worker"], 3)
+	assert.Equal(t, float64(1), dump.Components["worker"][0].Fields["task"])
+	assert.Equal(t, "broken", dump.Components["worker"][1].Message)
+	assert.Contains(t, dump.Components["worker"][1].Fields["encoding_error"], "unsupported type")
+	assert.Equal(t, float64(2), dump.Components["worker"][2].Fields["task"])
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk is full")
+}
+
+func TestFlightRecorderDumpOnPanicFailure(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	recorder := NewFlightRecorder(10, WithDumpOutput(failingWriter{}))
+	assert.PanicsWithValue(t, "boom", func() {
+		defer recorder.DumpOnPanic()
+		panic("boom")
+	})
+	assert.Contains(t, logged.String(), "flight recorder: dump on panic: disk is full")
+}
+
+func TestFlightRecorderConcurrentComponents(t *testing.T) {
+	recorder := NewFlightRecorder(100)
+
+	var wg sync.WaitGroup
+	for idx := 0; idx < 4; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			component := recorder.Component(fmt.Sprintf("worker-%d", idx%2))
+			for event := 0; event < 1000; event++ {
+				component.Record("log", "tick", nil)
+			}
+		}()
+	}
+	for idx := 0; idx < 10; idx++ {
+		_ = recorder.Dump(io.Discard, "concurrent")
+	}
+	wg.Wait()
+
+	dump := recorder.Snapshot("done")
+	assert.Len(t, dump.Components, 2)
+	assert.Len(t, dump.Components["worker-0"], 100)
+}
+
+func TestFlightRecorderDumpOnPanic(t *testing.T) {
+	var output bytes.Buffer
+	recorder := NewFlightRecorder(10, WithDumpOutput(&output))
+	recorder.Component("worker").Record("task", "processing order 42", nil)
+
+	assert.PanicsWithValue(t, "boom", func() {
+		defer recorder.DumpOnPanic()
+		panic("boom")
+	})
+
+	dump := decodeDump(t, output.Bytes())
+	assert.Equal(t, "panic: boom", dump.Reason)
+	assert.Equal(t, "processing order 42", dump.Components["worker"][0].Message)
+}
+
+func TestFlightRecorderDumpOnSignal(t *testing.T) {
+	var output syncBuffer
+	recorder := NewFlightRecorder(10, WithDumpOutput(&output))
+	recorder.Component("worker").Record("log", "waiting", nil)
+
+	stop := recorder.DumpOnSignal()
+	defer stop()
+
+	process, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	require.NoError(t, process.Signal(syscall.SIGQUIT))
+
+	require.Eventually(t, func() bool {
+		return len(output.Bytes()) > 0
+	}, time.Second, time.Millisecond*10)
+	stop()
+
+	dump := decodeDump(t, output.Bytes())
+	assert.Equal(t, "signal: quit", dump.Reason)
+	assert.Len(t, dump.Components["worker"], 1)
+}
+
+func TestFlightRecorderHTTPHandler(t *testing.T) {
+	recorder := NewFlightRecorder(10)
+	recorder.Component("api").Record("request", "GET /orders", map[string]any{"status": 200})
+	recorder.Component("api").Record("request", "GET /stream", map[string]any{"body": make(chan int)})
+
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/debug/recorder")
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	dump := decodeDump(t, body)
+	assert.Equal(t, "http: /debug/recorder", dump.Reason)
+	assert.Equal(t, float64(200), dump.Components["api"][0].Fields["status"])
+	assert.Contains(t, dump.Components["api"][1].Fields, "encoding_error")
+}
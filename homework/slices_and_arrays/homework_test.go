@@ -9,23 +9,45 @@ import (
 
 // go test -v homework_test.go
 
-type CircularQueue[T int | int8 | int16 | int32 | int64] struct {
+// QueueMode decides what Push does with a full queue
+type QueueMode int
+
+const (
+	Bounded     QueueMode = iota // rejects the value
+	Growing                      // doubles the capacity
+	Overwriting                  // drops the oldest value, which keeps a fixed-size history
+)
+
+type CircularQueue[T any] struct {
 	values            []T
 	size, front, rear int
+	mode              QueueMode
+}
+
+func NewCircularQueue[T any](size int) CircularQueue[T] {
+	return NewCircularQueueWithMode[T](size, Bounded)
 }
 
-func NewCircularQueue[T int | int8 | int16 | int32 | int64](size int) CircularQueue[T] {
+func NewCircularQueueWithMode[T any](size int, mode QueueMode) CircularQueue[T] {
 	return CircularQueue[T]{
 		values: make([]T, size),
 		size:   0,
 		front:  0,
 		rear:   0,
+		mode:   mode,
 	}
 }
 
 func (q *CircularQueue[T]) Push(value T) bool {
 	if q.Full() {
-		return false
+		switch {
+		case q.mode == Growing:
+			q.grow()
+		case q.mode == Overwriting && len(q.values) > 0:
+			q.Pop()
+		default:
+			return false
+		}
 	}
 
 	q.values[q.rear] = value
@@ -39,25 +61,29 @@ func (q *CircularQueue[T]) Pop() bool {
 		return false
 	}
 
+	var zero T
+	q.values[q.front] = zero // the popped value must not be kept alive by the queue
 	q.front = (q.front + 1) % len(q.values)
 	q.size--
 	return true
 }
 
-func (q *CircularQueue[T]) Front() T {
+func (q *CircularQueue[T]) Front() (T, bool) {
 	if q.Empty() {
-		return -1
+		var zero T
+		return zero, false
 	}
 
-	return q.values[q.front]
+	return q.values[q.front], true
 }
 
-func (q *CircularQueue[T]) Back() T {
+func (q *CircularQueue[T]) Back() (T, bool) {
 	if q.Empty() {
-		return -1
+		var zero T
+		return zero, false
 	}
 
-	return q.values[(q.rear+len(q.values)-1)%len(q.values)] // one full positive circular increment followed by one shift to the left
+	return q.values[(q.rear+len(q.values)-1)%len(q.values)], true // one full positive circular increment followed by one shift to the left
 }
 
 func (q *CircularQueue[T]) Empty() bool {
@@ -68,6 +94,38 @@ func (q *CircularQueue[T]) Full() bool {
 	return q.size == len(q.values)
 }
 
+func (q *CircularQueue[T]) Len() int {
+	return q.size
+}
+
+func (q *CircularQueue[T]) Cap() int {
+	return len(q.values)
+}
+
+// ForEach visits values from the oldest to the newest
+func (q *CircularQueue[T]) ForEach(action func(value T)) {
+	for idx := 0; idx < q.size; idx++ {
+		action(q.values[(q.front+idx)%len(q.values)])
+	}
+}
+
+// Values returns a copy of the values from the oldest to the newest
+func (q *CircularQueue[T]) Values() []T {
+	values := make([]T, 0, q.size)
+	q.ForEach(func(value T) {
+		values = append(values, value)
+	})
+	return values
+}
+
+// grow moves the values to a twice larger buffer, so the oldest one becomes the first
+func (q *CircularQueue[T]) grow() {
+	values := q.Values()
+	q.values = append(values, make([]T, max(1, len(q.values)*2)-len(values))...)
+	q.front = 0
+	q.rear = q.size % len(q.values)
+}
+
 func TestCircularQueue(t *testing.T) {
 	const queueSize = 3
 	queue := NewCircularQueue[int](queueSize)
@@ -75,8 +133,10 @@ func TestCircularQueue(t *testing.T) {
 	assert.True(t, queue.Empty())
 	assert.False(t, queue.Full())
 
-	assert.Equal(t, -1, queue.Front())
-	assert.Equal(t, -1, queue.Back())
+	_, found := queue.Front()
+	assert.False(t, found)
+	_, found = queue.Back()
+	assert.False(t, found)
 	assert.False(t, queue.Pop())
 
 	assert.True(t, queue.Push(1))
@@ -89,8 +149,7 @@ func TestCircularQueue(t *testing.T) {
 	assert.False(t, queue.Empty())
 	assert.True(t, queue.Full())
 
-	assert.Equal(t, 1, queue.Front())
-	assert.Equal(t, 3, queue.Back())
+	assertFrontBack(t, &queue, 1, 3)
 
 	assert.True(t, queue.Pop())
 	assert.False(t, queue.Empty())
@@ -99,8 +158,7 @@ func TestCircularQueue(t *testing.T) {
 
 	assert.True(t, reflect.DeepEqual([]int{4, 2, 3}, queue.values))
 
-	assert.Equal(t, 2, queue.Front())
-	assert.Equal(t, 4, queue.Back())
+	assertFrontBack(t, &queue, 2, 4)
 
 	assert.True(t, queue.Pop())
 	assert.True(t, queue.Pop())
@@ -110,3 +168,70 @@ func TestCircularQueue(t *testing.T) {
 	assert.True(t, queue.Empty())
 	assert.False(t, queue.Full())
 }
+
+func assertFrontBack[T any](t *testing.T, queue *CircularQueue[T], front, back T) {
+	t.Helper()
+	value, found := queue.Front()
+	assert.True(t, found)
+	assert.Equal(t, front, value)
+	value, found = queue.Back()
+	assert.True(t, found)
+	assert.Equal(t, back, value)
+}
+
+func TestCircularQueueStoresAnyValue(t *testing.T) {
+	type record struct {
+		level   string
+		message string
+	}
+
+	queue := NewCircularQueue[record](2)
+	assert.True(t, queue.Push(record{"info", "started"}))
+	assert.True(t, queue.Push(record{"error", "failed"}))
+	assertFrontBack(t, &queue, record{"info", "started"}, record{"error", "failed"})
+
+	numbers := NewCircularQueue[int](1)
+	assert.True(t, numbers.Push(-1)) // -1 is no longer reserved for an empty queue
+	assertFrontBack(t, &numbers, -1, -1)
+}
+
+func TestCircularQueueGrowing(t *testing.T) {
+	queue := NewCircularQueueWithMode[int](2, Growing)
+	queue.Push(1)
+	queue.Push(2)
+	queue.Pop()
+	queue.Push(3) // wraps around before growing
+
+	for value := 4; value <= 9; value++ {
+		assert.True(t, queue.Push(value))
+	}
+	assert.Equal(t, 8, queue.Len())
+	assert.Equal(t, 8, queue.Cap())
+	assert.Equal(t, []int{2, 3, 4, 5, 6, 7, 8, 9}, queue.Values())
+	assertFrontBack(t, &queue, 2, 9)
+
+	empty := NewCircularQueueWithMode[int](0, Growing)
+	assert.True(t, empty.Push(1))
+	assertFrontBack(t, &empty, 1, 1)
+}
+
+func TestCircularQueueOverwriting(t *testing.T) {
+	history := NewCircularQueueWithMode[string](3, Overwriting)
+	for _, event := range []string{"a", "b", "c", "d", "e"} {
+		assert.True(t, history.Push(event))
+	}
+
+	assert.True(t, history.Full())
+	assert.Equal(t, []string{"c", "d", "e"}, history.Values())
+	assertFrontBack(t, &history, "c", "e")
+
+	var visited []string
+	history.Pop()
+	history.ForEach(func(value string) {
+		visited = append(visited, value)
+	})
+	assert.Equal(t, []string{"d", "e"}, visited)
+
+	empty := NewCircularQueueWithMode[string](0, Overwriting)
+	assert.False(t, empty.Push("a"))
+}
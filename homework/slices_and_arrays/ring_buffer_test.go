@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -race ring_buffer_test.go
+// go test -bench=. ring_buffer_test.go
+
+// cacheLineSize keeps the indexes written by producers and consumers
+// on separate cache lines, otherwise every write invalidates the other side
+const cacheLineSize = 64
+
+type padding [cacheLineSize]byte
+
+// paddedIndex occupies a whole cache line
+type paddedIndex struct {
+	value atomic.Uint64
+	_     [cacheLineSize - 8]byte
+}
+
+const (
+	spinAttempts = 64
+	maxBackoff   = time.Millisecond
+)
+
+// Ring is a bounded queue which never blocks
+type Ring[T any] interface {
+	TryPush(value T) bool
+	TryPop() (T, bool)
+}
+
+// SPSCRing is a ring buffer for exactly one producer and one consumer goroutine
+type SPSCRing[T any] struct {
+	_      padding
+	head   paddedIndex // next slot to read, written by the consumer only
+	tail   paddedIndex // next slot to write, written by the producer only
+	values []T
+	mask   uint64
+
+	// every side caches the index of the other one and reloads it
+	// only when the ring looks full or empty, which saves cache misses
+	_          padding
+	cachedHead uint64 // used by the producer
+	_          padding
+	cachedTail uint64 // used by the consumer
+	_          padding
+}
+
+// NewSPSCRing creates a ring with the capacity rounded up to a power of two
+func NewSPSCRing[T any](capacity int) *SPSCRing[T] {
+	capacity = roundUpToPowerOfTwo(capacity)
+	return &SPSCRing[T]{
+		values: make([]T, capacity),
+		mask:   uint64(capacity - 1),
+	}
+}
+
+func (r *SPSCRing[T]) TryPush(value T) bool {
+	tail := r.tail.value.Load()
+	if tail-r.cachedHead == uint64(len(r.values)) {
+		if r.cachedHead = r.head.value.Load(); tail-r.cachedHead == uint64(len(r.values)) {
+			return false
+		}
+	}
+
+	r.values[tail&r.mask] = value
+	r.tail.value.Store(tail + 1) // publishes the value to the consumer
+	return true
+}
+
+func (r *SPSCRing[T]) TryPop() (T, bool) {
+	var zero T
+	head := r.head.value.Load()
+	if head == r.cachedTail {
+		if r.cachedTail = r.tail.value.Load(); head == r.cachedTail {
+			return zero, false
+		}
+	}
+
+	value := r.values[head&r.mask]
+	r.values[head&r.mask] = zero
+	r.head.value.Store(head + 1) // gives the slot back to the producer
+	return value, true
+}
+
+func (r *SPSCRing[T]) Put(ctx context.Context, value T) error {
+	return put[T](ctx, r, value)
+}
+
+func (r *SPSCRing[T]) Take(ctx context.Context) (T, error) {
+	return take[T](ctx, r)
+}
+
+// Len is exact only when called by the producer or the consumer
+func (r *SPSCRing[T]) Len() int {
+	return int(r.tail.value.Load() - r.head.value.Load())
+}
+
+func (r *SPSCRing[T]) Cap() int {
+	return len(r.values)
+}
+
+// mpmcSlot tells by its sequence whether it waits for a producer (sequence equals
+// the position) or for a consumer (sequence is one past the position)
+type mpmcSlot[T any] struct {
+	sequence atomic.Uint64
+	value    T
+}
+
+// MPMCRing is a ring buffer for any number of producers and consumers,
+// they claim positions with CAS and never wait for each other's locks
+type MPMCRing[T any] struct {
+	_     padding
+	head  paddedIndex
+	tail  paddedIndex
+	slots []mpmcSlot[T]
+	mask  uint64
+}
+
+// NewMPMCRing creates a ring with the capacity rounded up to a power of two
+func NewMPMCRing[T any](capacity int) *MPMCRing[T] {
+	capacity = roundUpToPowerOfTwo(capacity)
+	r := &MPMCRing[T]{
+		slots: make([]mpmcSlot[T], capacity),
+		mask:  uint64(capacity - 1),
+	}
+	for idx := range r.slots {
+		r.slots[idx].sequence.Store(uint64(idx))
+	}
+	return r
+}
+
+func (r *MPMCRing[T]) TryPush(value T) bool {
+	position := r.tail.value.Load()
+	for {
+		slot := &r.slots[position&r.mask]
+		switch sequence := slot.sequence.Load(); {
+		case sequence == position:
+			if r.tail.value.CompareAndSwap(position, position+1) {
+				slot.value = value
+				slot.sequence.Store(position + 1)
+				return true
+			}
+			position = r.tail.value.Load()
+		case sequence < position:
+			return false // the slot still holds a value from the previous lap
+		default:
+			position = r.tail.value.Load() // another producer took the position
+		}
+	}
+}
+
+func (r *MPMCRing[T]) TryPop() (T, bool) {
+	var zero T
+	position := r.head.value.Load()
+	for {
+		slot := &r.slots[position&r.mask]
+		switch sequence := slot.sequence.Load(); {
+		case sequence == position+1:
+			if r.head.value.CompareAndSwap(position, position+1) {
+				value := slot.value
+				slot.value = zero
+				slot.sequence.Store(position + uint64(len(r.slots))) // ready for the next lap
+				return value, true
+			}
+			position = r.head.value.Load()
+		case sequence < position+1:
+			return zero, false
+		default:
+			position = r.head.value.Load()
+		}
+	}
+}
+
+func (r *MPMCRing[T]) Put(ctx context.Context, value T) error {
+	return put[T](ctx, r, value)
+}
+
+func (r *MPMCRing[T]) Take(ctx context.Context) (T, error) {
+	return take[T](ctx, r)
+}
+
+// Len is approximate while producers or consumers are active
+func (r *MPMCRing[T]) Len() int {
+	head, tail := r.head.value.Load(), r.tail.value.Load()
+	if tail < head {
+		return 0
+	}
+	return int(min(tail-head, uint64(len(r.slots))))
+}
+
+func (r *MPMCRing[T]) Cap() int {
+	return len(r.slots)
+}
+
+func put[T any](ctx context.Context, ring Ring[T], value T) error {
+	for attempt := 0; !ring.TryPush(value); attempt++ {
+		if err := backoff(ctx, attempt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func take[T any](ctx context.Context, ring Ring[T]) (T, error) {
+	for attempt := 0; ; attempt++ {
+		if value, ok := ring.TryPop(); ok {
+			return value, nil
+		}
+		if err := backoff(ctx, attempt); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+}
+
+// backoff yields the processor for the first attempts and sleeps with
+// growing pauses later, so a stalled peer does not burn the CPU,
+// cancellation is noticed within maxBackoff
+func backoff(ctx context.Context, attempt int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if attempt < spinAttempts {
+		runtime.Gosched()
+	} else {
+		time.Sleep(min(time.Microsecond<<min(attempt-spinAttempts, 10), maxBackoff))
+	}
+	return nil
+}
+
+func roundUpToPowerOfTwo(value int) int {
+	power := 1
+	for power < value {
+		power <<= 1
+	}
+	return power
+}
+
+func TestSPSCRing(t *testing.T) {
+	ring := NewSPSCRing[int](3)
+	assert.Equal(t, 4, ring.Cap())
+
+	_, ok := ring.TryPop()
+	assert.False(t, ok)
+	for value := 1; value <= 4; value++ {
+		assert.True(t, ring.TryPush(value))
+	}
+	assert.False(t, ring.TryPush(5))
+	assert.Equal(t, 4, ring.Len())
+
+	value, ok := ring.TryPop()
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+	assert.True(t, ring.TryPush(5))
+}
+
+func TestSPSCRingConcurrent(t *testing.T) {
+	const count = 100_000
+	ring := NewSPSCRing[int](64)
+	ctx := context.Background()
+
+	go func() {
+		for value := 0; value < count; value++ {
+			_ = ring.Put(ctx, value)
+		}
+	}()
+
+	for expected := 0; expected < count; expected++ {
+		value, err := ring.Take(ctx)
+		assert.NoError(t, err)
+		if value != expected {
+			t.Fatalf("got %d instead of %d", value, expected)
+		}
+	}
+}
+
+func TestMPMCRing(t *testing.T) {
+	ring := NewMPMCRing[string](2)
+	assert.True(t, ring.TryPush("a"))
+	assert.True(t, ring.TryPush("b"))
+	assert.False(t, ring.TryPush("c"))
+	assert.Equal(t, 2, ring.Len())
+
+	for _, expected := range []string{"a", "b"} {
+		value, ok := ring.TryPop()
+		assert.True(t, ok)
+		assert.Equal(t, expected, value)
+	}
+	_, ok := ring.TryPop()
+	assert.False(t, ok)
+	assert.True(t, ring.TryPush("c")) // the second lap reuses the slots
+}
+
+func TestMPMCRingConcurrent(t *testing.T) {
+	const producers, consumers = 4, 4
+	const perProducer = 20_000
+	ring := NewMPMCRing[int](128)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	wg.Add(producers)
+	for producer := 0; producer < producers; producer++ {
+		go func() {
+			defer wg.Done()
+			for idx := 0; idx < perProducer; idx++ {
+				_ = ring.Put(ctx, producer*perProducer+idx)
+			}
+		}()
+	}
+
+	seen := make([]atomic.Bool, producers*perProducer)
+	var received atomic.Int64
+	var consumed sync.WaitGroup
+	consumed.Add(consumers)
+	for consumer := 0; consumer < consumers; consumer++ {
+		go func() {
+			defer consumed.Done()
+			for received.Add(1) <= producers*perProducer {
+				value, err := ring.Take(ctx)
+				assert.NoError(t, err)
+				assert.False(t, seen[value].Swap(true), "value %d is received twice", value)
+			}
+		}()
+	}
+
+	wg.Wait()
+	consumed.Wait()
+	for idx := range seen {
+		assert.True(t, seen[idx].Load(), "value %d is lost", idx)
+	}
+}
+
+func TestRingBlockingCancellation(t *testing.T) {
+	ring := NewMPMCRing[int](1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	_, err := ring.Take(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	spsc := NewSPSCRing[int](1)
+	assert.NoError(t, spsc.Put(context.Background(), 1))
+	assert.ErrorIs(t, spsc.Put(ctx, 2), context.DeadlineExceeded)
+}
+
+func BenchmarkSPSCRing(b *testing.B) {
+	ring := NewSPSCRing[int](1024)
+	ctx := context.Background()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			_ = ring.Put(ctx, i)
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		_, _ = ring.Take(ctx)
+	}
+}
+
+func BenchmarkSPSCChannel(b *testing.B) {
+	channel := make(chan int, 1024)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			channel <- i
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		<-channel
+	}
+}
+
+// benchmarkMPMC moves b.N values through producers and consumers
+// for every processor, put and take wrap the queue under test
+func benchmarkMPMC(b *testing.B, put func(value int), take func()) {
+	workers := runtime.GOMAXPROCS(0)
+	var wg sync.WaitGroup
+	wg.Add(workers * 2)
+	for worker := 0; worker < workers; worker++ {
+		count := b.N / workers
+		if worker == 0 {
+			count += b.N % workers
+		}
+		go func() {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				put(i)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				take()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkMPMCRing(b *testing.B) {
+	ring := NewMPMCRing[int](1024)
+	ctx := context.Background()
+	benchmarkMPMC(b, func(value int) {
+		_ = ring.Put(ctx, value)
+	}, func() {
+		_, _ = ring.Take(ctx)
+	})
+}
+
+func BenchmarkMPMCChannel(b *testing.B) {
+	channel := make(chan int, 1024)
+	benchmarkMPMC(b, func(value int) {
+		channel <- value
+	}, func() {
+		<-channel
+	})
+}
@@ -1,34 +1,40 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"reflect"
-	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"unsafe"
 )
 
+var ErrBufferClosed = errors.New("cow buffer: use after close")
+
+// COWBuffer is a handle to data shared with its clones, every handle
+// belongs to one goroutine, other goroutines get their own handles by Clone
 type COWBuffer struct {
-	data []byte
-	refs *int
+	data   []byte
+	refs   *atomic.Int64 // live handles sharing data, the data can be changed in place only when it is 1
+	closed bool
 }
 
+// NewCOWBuffer needs no finalizer: a handle that is never closed only makes
+// the others copy the data once more, the memory is reclaimed by GC anyway
 func NewCOWBuffer(data []byte) COWBuffer {
 	b := COWBuffer{
-		data: data,     // not a copy of `data` here since tests require the original and buffer's arrays to be the same in terms of memory
-		refs: new(int), // is a pointer since copies of buffer must share this value, *refs > 0 if active copies are present
+		data: data, // not a copy of `data` here since tests require the original and buffer's arrays to be the same in terms of memory
+		refs: new(atomic.Int64),
 	}
-
-	runtime.SetFinalizer(&b, func(b *COWBuffer) {
-		b.Close()
-	})
-
+	b.refs.Store(1)
 	return b
 }
 
 func (b *COWBuffer) Clone() COWBuffer {
-	*b.refs++
+	b.checkOpen()
+	b.refs.Add(1)
 
 	return COWBuffer{
 		data: b.data,
@@ -36,29 +42,48 @@ func (b *COWBuffer) Clone() COWBuffer {
 	}
 }
 
+// Close releases the handle, closing it again does nothing
 func (b *COWBuffer) Close() {
-	*b.refs--
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+	b.refs.Add(-1)
+	b.data = nil
 }
 
 func (b *COWBuffer) Update(index int, value byte) bool {
-	if b == nil || index < 0 || index >= len(b.data) {
+	if b == nil {
+		return false
+	}
+	b.checkOpen()
+	if index < 0 || index >= len(b.data) {
 		return false
 	}
 
-	// if copies were made, then we make a new data and new refs before changing the value
-	if *b.refs > 0 {
-		*b.refs--
+	// if other handles share the data, then we make a new data and new refs before changing the value
+	if b.refs.Load() > 1 {
 		newData := make([]byte, len(b.data))
 		copy(newData, b.data)
-		nb := NewCOWBuffer(newData)
-		*b = nb
+		b.refs.Add(-1)
+		*b = NewCOWBuffer(newData)
 	}
 
 	b.data[index] = value
 	return true
 }
 
+func (b *COWBuffer) checkOpen() {
+	if b.closed {
+		panic(ErrBufferClosed)
+	}
+}
+
+// String shares memory with the buffer, so it changes
+// if the buffer is updated in place later
 func (b *COWBuffer) String() string {
+	b.checkOpen()
 	if len(b.data) == 0 {
 		return ""
 	}
@@ -107,3 +132,57 @@ func TestCOWBuffer(t *testing.T) {
 
 	copy2.Close()
 }
+
+func TestCOWBufferClose(t *testing.T) {
+	buffer := NewCOWBuffer([]byte("data"))
+	clone := buffer.Clone()
+
+	clone.Close()
+	clone.Close() // idempotent, must not release the reference of another handle
+	assert.Equal(t, int64(1), buffer.refs.Load())
+
+	assert.PanicsWithValue(t, ErrBufferClosed, func() { clone.Update(0, 'x') })
+	assert.PanicsWithValue(t, ErrBufferClosed, func() { _ = clone.String() })
+	assert.PanicsWithValue(t, ErrBufferClosed, func() { clone.Clone() })
+
+	// the only handle left owns the data and changes it in place
+	previous := unsafe.SliceData(buffer.data)
+	assert.True(t, buffer.Update(0, 'D'))
+	assert.Equal(t, previous, unsafe.SliceData(buffer.data))
+	assert.Equal(t, "Data", buffer.String())
+
+	buffer.Close()
+	assert.Zero(t, buffer.refs.Load())
+}
+
+func TestCOWBufferConcurrentClones(t *testing.T) {
+	const goroutines = 8
+	payload := []byte("shared payload")
+	buffer := NewCOWBuffer(payload)
+
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for idx := 0; idx < goroutines; idx++ {
+		clone := buffer.Clone() // handles are cloned by the owner and handed over
+		go func() {
+			defer wg.Done()
+			defer clone.Close()
+
+			for i := 0; i < 100; i++ {
+				inner := clone.Clone()
+				assert.Equal(t, byte('s'), inner.data[0])
+				inner.Close()
+			}
+			assert.True(t, clone.Update(0, byte('0'+idx)))
+			assert.Equal(t, byte('0'+idx), clone.data[0])
+		}()
+	}
+	wg.Wait()
+
+	// every goroutine wrote to a private copy, the original is intact
+	assert.Equal(t, "shared payload", buffer.String())
+	assert.Equal(t, int64(1), buffer.refs.Load())
+	assert.True(t, buffer.Update(0, 'S'))
+	assert.Equal(t, unsafe.SliceData(payload), unsafe.SliceData(buffer.data))
+	buffer.Close()
+}
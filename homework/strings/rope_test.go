@@ -0,0 +1,512 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// go test -v rope_test.go
+
+// maxLeafSize bounds the text of a leaf, so that finding a rune
+// inside a leaf stays cheap and small edits copy little
+const maxLeafSize = 1024
+
+// ropeNode is immutable, so versions of a rope share every node
+// an edit did not touch. Leaves hold text, inner nodes hold the totals
+// of their subtrees and are kept AVL-balanced
+type ropeNode struct {
+	left, right *ropeNode
+	text        string
+	height      int
+	bytes       int
+	runes       int
+	newlines    int
+}
+
+// Rope is an immutable text, edits return a new version in O(log n)
+// and leave the original intact. Positions are counted in runes,
+// out of range positions panic like slice indexes do
+type Rope struct {
+	root *ropeNode
+}
+
+func NewRope(text string) Rope {
+	return Rope{root: buildRope(text)}
+}
+
+func (r Rope) Len() int {
+	return runes(r.root)
+}
+
+func (r Rope) ByteLen() int {
+	if r.root == nil {
+		return 0
+	}
+	return r.root.bytes
+}
+
+// LineCount counts lines like editors do, the text after the last newline is a line too
+func (r Rope) LineCount() int {
+	if r.root == nil {
+		return 1
+	}
+	return r.root.newlines + 1
+}
+
+func (r Rope) Insert(index int, text string) Rope {
+	checkRange(index, r.Len())
+	left, right := split(r.root, index)
+	return Rope{root: concat(concat(left, buildRope(text)), right)}
+}
+
+// Delete removes runes in [start, end)
+func (r Rope) Delete(start, end int) Rope {
+	checkSlice(start, end, r.Len())
+	left, _ := split(r.root, start)
+	_, right := split(r.root, end)
+	return Rope{root: concat(left, right)}
+}
+
+// Slice returns runes in [start, end), the result shares the text with r
+func (r Rope) Slice(start, end int) Rope {
+	checkSlice(start, end, r.Len())
+	_, right := split(r.root, start)
+	middle, _ := split(right, end-start)
+	return Rope{root: middle}
+}
+
+func (r Rope) Append(other Rope) Rope {
+	return Rope{root: concat(r.root, other.root)}
+}
+
+func (r Rope) RuneAt(index int) rune {
+	checkRange(index, r.Len()-1)
+	node := r.root
+	for node.left != nil {
+		if index < node.left.runes {
+			node = node.left
+		} else {
+			index -= node.left.runes
+			node = node.right
+		}
+	}
+
+	value, _ := utf8.DecodeRuneInString(node.text[byteOffset(node.text, index):])
+	return value
+}
+
+// LineStart returns the index of the first rune of the line
+func (r Rope) LineStart(line int) int {
+	checkRange(line, r.LineCount()-1)
+	if line == 0 {
+		return 0
+	}
+	return r.newlineIndex(line-1) + 1
+}
+
+// Line returns the line without its newline
+func (r Rope) Line(line int) Rope {
+	start := r.LineStart(line)
+	end := r.Len()
+	if line < r.LineCount()-1 {
+		end = r.newlineIndex(line)
+	}
+	return r.Slice(start, end)
+}
+
+// newlineIndex returns the rune index of the newline with the given number
+func (r Rope) newlineIndex(number int) int {
+	index := 0
+	node := r.root
+	for node.left != nil {
+		if number < node.left.newlines {
+			node = node.left
+		} else {
+			number -= node.left.newlines
+			index += node.left.runes
+			node = node.right
+		}
+	}
+
+	for _, value := range node.text {
+		if value == '\n' {
+			if number == 0 {
+				return index
+			}
+			number--
+		}
+		index++
+	}
+	panic("rope: inconsistent newline count")
+}
+
+// String concatenates the leaves into a new string, the rope itself stays as it is
+func (r Rope) String() string {
+	var builder strings.Builder
+	builder.Grow(r.ByteLen())
+	forEachLeaf(r.root, func(text string) {
+		builder.WriteString(text)
+	})
+	return builder.String()
+}
+
+// Reader streams the text leaf by leaf without building the whole string
+func (r Rope) Reader() io.Reader {
+	reader := &ropeReader{}
+	if r.root != nil {
+		reader.stack = append(reader.stack, r.root)
+	}
+	return reader
+}
+
+type ropeReader struct {
+	stack   []*ropeNode // nodes to visit, the next one is on top
+	current string
+}
+
+func (r *ropeReader) Read(buffer []byte) (int, error) {
+	for len(r.current) == 0 {
+		if len(r.stack) == 0 {
+			return 0, io.EOF
+		}
+
+		node := r.stack[len(r.stack)-1]
+		r.stack = r.stack[:len(r.stack)-1]
+		if node.left == nil {
+			r.current = node.text
+		} else {
+			r.stack = append(r.stack, node.right, node.left)
+		}
+	}
+
+	count := copy(buffer, r.current)
+	r.current = r.current[count:]
+	return count, nil
+}
+
+func forEachLeaf(node *ropeNode, action func(text string)) {
+	if node == nil {
+		return
+	}
+	if node.left == nil {
+		action(node.text)
+		return
+	}
+	forEachLeaf(node.left, action)
+	forEachLeaf(node.right, action)
+}
+
+// buildRope cuts text into leaves at rune boundaries without copying
+// and joins them into a balanced tree
+func buildRope(text string) *ropeNode {
+	var leaves []*ropeNode
+	for len(text) > 0 {
+		size := min(len(text), maxLeafSize)
+		for size < len(text) && !utf8.RuneStart(text[size]) {
+			size--
+		}
+		leaves = append(leaves, newLeaf(text[:size]))
+		text = text[size:]
+	}
+
+	return joinLeaves(leaves)
+}
+
+// joinLeaves splits leaves in halves, so subtree heights differ by one at most
+func joinLeaves(leaves []*ropeNode) *ropeNode {
+	switch len(leaves) {
+	case 0:
+		return nil
+	case 1:
+		return leaves[0]
+	default:
+		middle := len(leaves) / 2
+		return newNode(joinLeaves(leaves[:middle]), joinLeaves(leaves[middle:]))
+	}
+}
+
+func newLeaf(text string) *ropeNode {
+	if len(text) == 0 {
+		return nil
+	}
+	return &ropeNode{
+		text:     text,
+		height:   1,
+		bytes:    len(text),
+		runes:    utf8.RuneCountInString(text),
+		newlines: strings.Count(text, "\n"),
+	}
+}
+
+func newNode(left, right *ropeNode) *ropeNode {
+	return &ropeNode{
+		left:     left,
+		right:    right,
+		height:   1 + max(left.height, right.height),
+		bytes:    left.bytes + right.bytes,
+		runes:    left.runes + right.runes,
+		newlines: left.newlines + right.newlines,
+	}
+}
+
+func height(node *ropeNode) int {
+	if node == nil {
+		return 0
+	}
+	return node.height
+}
+
+func runes(node *ropeNode) int {
+	if node == nil {
+		return 0
+	}
+	return node.runes
+}
+
+// concat joins two balanced trees descending along the edge of the higher
+// one, so it costs the difference of their heights. Small neighbouring
+// leaves are merged, otherwise every typed rune would become a leaf
+func concat(left, right *ropeNode) *ropeNode {
+	switch {
+	case left == nil:
+		return right
+	case right == nil:
+		return left
+	case left.left == nil && right.left == nil && left.bytes+right.bytes <= maxLeafSize:
+		return newLeaf(left.text + right.text)
+	}
+
+	switch diff := left.height - right.height; {
+	case diff > 1:
+		return rebalance(newNode(left.left, concat(left.right, right)))
+	case diff < -1:
+		return rebalance(newNode(concat(left, right.left), right.right))
+	default:
+		return newNode(left, right)
+	}
+}
+
+// split cuts the tree before the rune with the given index
+func split(node *ropeNode, index int) (*ropeNode, *ropeNode) {
+	switch {
+	case node == nil || index <= 0:
+		return nil, node
+	case index >= node.runes:
+		return node, nil
+	case node.left == nil:
+		offset := byteOffset(node.text, index)
+		return newLeaf(node.text[:offset]), newLeaf(node.text[offset:])
+	case index <= node.left.runes:
+		left, right := split(node.left, index)
+		return left, concat(right, node.right)
+	default:
+		left, right := split(node.right, index-node.left.runes)
+		return concat(node.left, left), right
+	}
+}
+
+// rebalance fixes a node whose subtrees differ in height by two
+func rebalance(node *ropeNode) *ropeNode {
+	switch diff := height(node.left) - height(node.right); {
+	case diff > 1:
+		if height(node.left.left) < height(node.left.right) {
+			node = newNode(rotateLeft(node.left), node.right)
+		}
+		return rotateRight(node)
+	case diff < -1:
+		if height(node.right.right) < height(node.right.left) {
+			node = newNode(node.left, rotateRight(node.right))
+		}
+		return rotateLeft(node)
+	default:
+		return node
+	}
+}
+
+func rotateRight(node *ropeNode) *ropeNode {
+	pivot := node.left
+	return newNode(pivot.left, newNode(pivot.right, node.right))
+}
+
+func rotateLeft(node *ropeNode) *ropeNode {
+	pivot := node.right
+	return newNode(newNode(node.left, pivot.left), pivot.right)
+}
+
+func byteOffset(text string, index int) int {
+	if len(text) == utf8.RuneCountInString(text) {
+		return index // ASCII
+	}
+	for offset := range text {
+		if index == 0 {
+			return offset
+		}
+		index--
+	}
+	return len(text)
+}
+
+func checkRange(index, limit int) {
+	if index < 0 || index > limit {
+		panic(fmt.Sprintf("rope: index %d out of range [0:%d]", index, limit))
+	}
+}
+
+func checkSlice(start, end, length int) {
+	if start < 0 || end < start || end > length {
+		panic(fmt.Sprintf("rope: slice bounds [%d:%d] out of range with length %d", start, end, length))
+	}
+}
+
+// checkRope verifies cached totals and balance of every node
+func checkRope(t *testing.T, node *ropeNode) {
+	t.Helper()
+	if node == nil {
+		return
+	}
+	if node.left == nil {
+		assert.NotEmpty(t, node.text)
+		assert.LessOrEqual(t, node.bytes, maxLeafSize)
+		return
+	}
+
+	checkRope(t, node.left)
+	checkRope(t, node.right)
+	require.Equal(t, 1+max(node.left.height, node.right.height), node.height)
+	require.LessOrEqual(t, abs(node.left.height-node.right.height), 1)
+	require.Equal(t, node.left.runes+node.right.runes, node.runes)
+	require.Equal(t, node.left.newlines+node.right.newlines, node.newlines)
+}
+
+func abs(value int) int {
+	return max(value, -value)
+}
+
+func TestRope(t *testing.T) {
+	rope := NewRope("Hello, world")
+	assert.Equal(t, 12, rope.Len())
+
+	edited := rope.Insert(7, "дорогой ").Delete(0, 5).Insert(0, "Привет")
+	assert.Equal(t, "Привет, дорогой world", edited.String())
+	assert.Equal(t, "Hello, world", rope.String()) // versions are independent
+	assert.Equal(t, 21, edited.Len())
+	assert.Equal(t, len("Привет, дорогой world"), edited.ByteLen())
+
+	assert.Equal(t, 'П', edited.RuneAt(0))
+	assert.Equal(t, 'д', edited.RuneAt(8))
+	assert.Equal(t, "дорогой", edited.Slice(8, 15).String())
+
+	assert.Equal(t, "", NewRope("").String())
+	assert.Equal(t, "abc", NewRope("").Insert(0, "abc").String())
+	assert.Equal(t, "ab", NewRope("a").Append(NewRope("b")).String())
+
+	assert.Panics(t, func() { rope.Insert(13, "x") })
+	assert.Panics(t, func() { rope.Delete(5, 4) })
+	assert.Panics(t, func() { rope.RuneAt(12) })
+}
+
+func TestRopeLines(t *testing.T) {
+	rope := NewRope("first\nвторая\n\nlast")
+	assert.Equal(t, 4, rope.LineCount())
+
+	var lines []string
+	for line := 0; line < rope.LineCount(); line++ {
+		lines = append(lines, rope.Line(line).String())
+	}
+	assert.Equal(t, []string{"first", "вторая", "", "last"}, lines)
+	assert.Equal(t, 13, rope.LineStart(2))
+
+	trailing := NewRope("line\n")
+	assert.Equal(t, 2, trailing.LineCount())
+	assert.Equal(t, "", trailing.Line(1).String())
+	assert.Equal(t, 1, NewRope("").LineCount())
+	assert.Panics(t, func() { trailing.Line(2) })
+}
+
+func TestRopeSharesText(t *testing.T) {
+	text := strings.Repeat("0123456789", 1000)
+	rope := NewRope(text)
+
+	// a slice points into the original string instead of copying it
+	slice := rope.Slice(2500, 2600)
+	leaf := slice.root
+	for leaf.left != nil {
+		leaf = leaf.left
+	}
+	start := uintptr(unsafe.Pointer(unsafe.StringData(text)))
+	assert.Equal(t, start+2500, uintptr(unsafe.Pointer(unsafe.StringData(leaf.text))))
+
+	// an edit rebuilds only the path to the changed leaf
+	edited := rope.Insert(5000, "!")
+	shared := 0
+	forEachLeaf(edited.root, func(edited string) {
+		forEachLeaf(rope.root, func(original string) {
+			if unsafe.StringData(edited) == unsafe.StringData(original) && len(edited) == len(original) {
+				shared++
+			}
+		})
+	})
+	assert.GreaterOrEqual(t, shared, len(text)/maxLeafSize-2)
+}
+
+func TestRopeReader(t *testing.T) {
+	text := strings.Repeat("строка с текстом\n", 500)
+	rope := NewRope(text).Insert(100, "вставка")
+	expected := []rune(text)
+	expected = append(expected[:100], append([]rune("вставка"), expected[100:]...)...)
+
+	assert.NoError(t, iotest.TestReader(rope.Reader(), []byte(string(expected))))
+
+	data, err := io.ReadAll(NewRope("").Reader())
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func TestRopeRandomEdits(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	alphabet := []rune("abcабв\n€😀")
+	randomText := func(length int) string {
+		text := make([]rune, length)
+		for idx := range text {
+			text[idx] = alphabet[random.Intn(len(alphabet))]
+		}
+		return string(text)
+	}
+
+	reference := []rune(randomText(5000))
+	rope := NewRope(string(reference))
+	for step := 0; step < 2000; step++ {
+		switch position := random.Intn(len(reference) + 1); random.Intn(3) {
+		case 0, 1:
+			text := randomText(random.Intn(2000) + 1)
+			rope = rope.Insert(position, text)
+			reference = append(reference[:position], append([]rune(text), reference[position:]...)...)
+		default:
+			end := min(len(reference), position+random.Intn(3000))
+			rope = rope.Delete(position, end)
+			reference = append(reference[:position], reference[end:]...)
+		}
+	}
+
+	checkRope(t, rope.root)
+	require.Equal(t, string(reference), rope.String())
+	require.Equal(t, len(reference), rope.Len())
+	for idx := 0; idx < len(reference); idx += 97 {
+		require.Equal(t, reference[idx], rope.RuneAt(idx))
+	}
+
+	lines := strings.Split(string(reference), "\n")
+	require.Equal(t, len(lines), rope.LineCount())
+	for idx := 0; idx < len(lines); idx += 13 {
+		require.Equal(t, lines[idx], rope.Line(idx).String())
+	}
+}
@@ -0,0 +1,400 @@
+// Package bitpack packs small integer and boolean fields into one machine word.
+// A layout is described by a struct whose fields carry tags:
+//
+//	type attributes struct {
+//		Mana  uint16 `bits:"10" range:"0,1000"`
+//		Armed bool   `bits:"1"`
+//		_     uint8  `bits:"5"` // reserved, must stay zero
+//	}
+//
+// Fields are placed from the highest bits down in declaration order, the width
+// of the layout is the sum of the field widths. A value is stored as its offset
+// from the lower bound of the range, so negative ranges need no sign bit.
+// Layouts are inspected by reflection once, accessors cost only shifts and masks.
+// Accessors are made from selectors of the struct fields, so a misspelled
+// field is a compile error:
+//
+//	mana := bitpack.MustInt[uint32](layout, func(a *attributes) *uint16 { return &a.Mana })
+package bitpack
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unsafe"
+)
+
+var (
+	ErrOutOfRange   = errors.New("bitpack: value out of range")
+	ErrReservedBits = errors.New("bitpack: reserved bits are set")
+	ErrLayout       = errors.New("bitpack: invalid layout")
+)
+
+// Word is a storage for packed fields
+type Word interface {
+	~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// Integer is a type of integer fields
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+type Field struct {
+	Name     string
+	Shift    int // position of the lowest bit
+	Bits     int
+	Min, Max int64
+	Kind     reflect.Kind
+	Reserved bool // declared with the blank name, always zero
+	index    int
+}
+
+func (f Field) mask() uint64 {
+	return math.MaxUint64 >> (64 - f.Bits)
+}
+
+type Layout struct {
+	typ    reflect.Type
+	fields []Field
+	width  int
+}
+
+// Compile inspects the tags of a struct type
+func Compile(typ reflect.Type) (*Layout, error) {
+	if typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%w: %s is not a struct", ErrLayout, typ)
+	}
+
+	layout := &Layout{typ: typ}
+	for idx := 0; idx < typ.NumField(); idx++ {
+		field, err := parseField(typ.Field(idx))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s.%s: %w", ErrLayout, typ.Name(), typ.Field(idx).Name, err)
+		}
+		field.index = idx
+		layout.fields = append(layout.fields, field)
+		layout.width += field.Bits
+	}
+	if layout.width > 64 {
+		return nil, fmt.Errorf("%w: %s needs %d bits", ErrLayout, typ.Name(), layout.width)
+	}
+
+	shift := layout.width
+	for idx := range layout.fields {
+		shift -= layout.fields[idx].Bits
+		layout.fields[idx].Shift = shift
+	}
+	return layout, nil
+}
+
+func MustCompile[T any]() *Layout {
+	layout, err := Compile(reflect.TypeFor[T]())
+	if err != nil {
+		panic(err)
+	}
+	return layout
+}
+
+func parseField(field reflect.StructField) (Field, error) {
+	result := Field{Name: field.Name, Kind: field.Type.Kind(), Reserved: field.Name == "_"}
+	if !result.Reserved && !field.IsExported() {
+		return result, errors.New("unexported fields cannot be unpacked")
+	}
+
+	tag, found := field.Tag.Lookup("bits")
+	if !found {
+		return result, errors.New("no bits tag")
+	}
+	bits, err := strconv.Atoi(tag)
+	if err != nil || bits < 1 || bits > 64 {
+		return result, fmt.Errorf("bits %q must be a number from 1 to 64", tag)
+	}
+	result.Bits = bits
+
+	switch {
+	case result.Reserved:
+		return result, nil
+	case result.Kind == reflect.Bool:
+		if bits != 1 {
+			return result, errors.New("bool takes exactly 1 bit")
+		}
+		result.Max = 1
+		return result, nil
+	case !isInteger(result.Kind):
+		return result, fmt.Errorf("unsupported type %s", field.Type)
+	}
+
+	result.Min, result.Max = 0, int64(min(result.mask(), math.MaxInt64))
+	if tag, found := field.Tag.Lookup("range"); found {
+		bounds := strings.Split(tag, ",")
+		if len(bounds) != 2 {
+			return result, fmt.Errorf("range %q must be \"min,max\"", tag)
+		}
+		if result.Min, err = strconv.ParseInt(strings.TrimSpace(bounds[0]), 10, 64); err != nil {
+			return result, fmt.Errorf("range %q: %w", tag, err)
+		}
+		if result.Max, err = strconv.ParseInt(strings.TrimSpace(bounds[1]), 10, 64); err != nil {
+			return result, fmt.Errorf("range %q: %w", tag, err)
+		}
+	}
+
+	switch {
+	case result.Min > result.Max:
+		return result, fmt.Errorf("empty range [%d, %d]", result.Min, result.Max)
+	case uint64(result.Max-result.Min) > result.mask():
+		return result, fmt.Errorf("range [%d, %d] does not fit in %d bits", result.Min, result.Max, bits)
+	case !fitsType(field.Type, result.Min) || !fitsType(field.Type, result.Max):
+		return result, fmt.Errorf("range [%d, %d] does not fit in %s", result.Min, result.Max, field.Type)
+	}
+	return result, nil
+}
+
+func isInteger(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Uint64
+}
+
+func fitsType(typ reflect.Type, value int64) bool {
+	if typ.Kind() >= reflect.Uint {
+		return value >= 0 && !reflect.Zero(typ).OverflowUint(uint64(value))
+	}
+	return !reflect.Zero(typ).OverflowInt(value)
+}
+
+// Width is the number of used bits
+func (l *Layout) Width() int {
+	return l.width
+}
+
+func (l *Layout) Fields() []Field {
+	return append([]Field(nil), l.fields...)
+}
+
+func (l *Layout) Field(name string) (Field, bool) {
+	for _, field := range l.fields {
+		if field.Name == name && !field.Reserved {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+// Validate checks that every field of the word is within its range,
+// reserved bits and bits above the layout are zero
+func (l *Layout) Validate(word uint64) error {
+	if l.width < 64 && word>>l.width != 0 {
+		return fmt.Errorf("%w: bits above %d", ErrReservedBits, l.width)
+	}
+	for _, field := range l.fields {
+		raw := word >> field.Shift & field.mask()
+		switch {
+		case field.Reserved && raw != 0:
+			return fmt.Errorf("%w: %d-%d", ErrReservedBits, field.Shift+field.Bits-1, field.Shift)
+		case !field.Reserved && raw > uint64(field.Max-field.Min):
+			return fmt.Errorf("%w: %s = %d, allowed [%d, %d]", ErrOutOfRange, field.Name, int64(raw)+field.Min, field.Min, field.Max)
+		}
+	}
+	return nil
+}
+
+// Pack stores every field of value, which must have the type of the layout
+func (l *Layout) Pack(value any) (uint64, error) {
+	source := reflect.ValueOf(value)
+	if source.Kind() == reflect.Pointer {
+		source = source.Elem()
+	}
+	if source.Type() != l.typ {
+		return 0, fmt.Errorf("%w: %s packs %s, not %s", ErrLayout, l.typ.Name(), l.typ, source.Type())
+	}
+
+	var word uint64
+	for _, field := range l.fields {
+		if field.Reserved {
+			continue
+		}
+
+		var value int64
+		switch fieldValue := source.Field(field.index); {
+		case field.Kind == reflect.Bool:
+			if fieldValue.Bool() {
+				value = 1
+			}
+		case field.Kind >= reflect.Uint:
+			if fieldValue.Uint() > math.MaxInt64 {
+				return 0, fmt.Errorf("%w: %s = %d, allowed [%d, %d]", ErrOutOfRange, field.Name, fieldValue.Uint(), field.Min, field.Max)
+			}
+			value = int64(fieldValue.Uint())
+		default:
+			value = fieldValue.Int()
+		}
+
+		if value < field.Min || value > field.Max {
+			return 0, fmt.Errorf("%w: %s = %d, allowed [%d, %d]", ErrOutOfRange, field.Name, value, field.Min, field.Max)
+		}
+		word |= uint64(value-field.Min) << field.Shift
+	}
+	return word, nil
+}
+
+// Unpack fills the struct target points to, the word is validated first
+func (l *Layout) Unpack(word uint64, target any) error {
+	destination := reflect.ValueOf(target)
+	if destination.Kind() != reflect.Pointer || destination.Elem().Type() != l.typ {
+		return fmt.Errorf("%w: %s unpacks into *%s, not %T", ErrLayout, l.typ.Name(), l.typ, target)
+	}
+	if err := l.Validate(word); err != nil {
+		return err
+	}
+
+	destination = destination.Elem()
+	for _, field := range l.fields {
+		if field.Reserved {
+			continue
+		}
+
+		value := int64(word>>field.Shift&field.mask()) + field.Min
+		switch fieldValue := destination.Field(field.index); {
+		case field.Kind == reflect.Bool:
+			fieldValue.SetBool(value == 1)
+		case field.Kind >= reflect.Uint:
+			fieldValue.SetUint(uint64(value))
+		default:
+			fieldValue.SetInt(value)
+		}
+	}
+	return nil
+}
+
+// Report describes the layout from the highest bits down
+func (l *Layout) Report() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%s: %d bits\n", l.typ.Name(), l.width)
+
+	writer := tabwriter.NewWriter(&builder, 0, 0, 2, ' ', 0)
+	for _, field := range l.fields {
+		bits := strconv.Itoa(field.Shift)
+		if field.Bits > 1 {
+			bits = fmt.Sprintf("%d-%d", field.Shift+field.Bits-1, field.Shift)
+		}
+
+		var values string
+		switch {
+		case field.Reserved:
+			values = "reserved"
+		case field.Kind == reflect.Bool:
+			values = "bool"
+		default:
+			values = fmt.Sprintf("[%d, %d]", field.Min, field.Max)
+		}
+		fmt.Fprintf(writer, "  %s\t%s\t%d\t%s\n", bits, field.Name, field.Bits, values)
+	}
+	_ = writer.Flush()
+	return builder.String()
+}
+
+// IntField reads and writes one integer field of a word
+type IntField[W Word] struct {
+	name     string
+	shift    uint
+	mask     uint64
+	min, max int64
+}
+
+// Int makes an accessor of the integer field the selector points to,
+// the layout must be compiled from T and fit in W
+func Int[W Word, T any, V Integer](layout *Layout, selector func(*T) *V) (IntField[W], error) {
+	field, err := lookup[W](layout, selector)
+	if err != nil {
+		return IntField[W]{}, err
+	}
+	return IntField[W]{name: field.Name, shift: uint(field.Shift), mask: field.mask(), min: field.Min, max: field.Max}, nil
+}
+
+func MustInt[W Word, T any, V Integer](layout *Layout, selector func(*T) *V) IntField[W] {
+	field, err := Int[W](layout, selector)
+	if err != nil {
+		panic(err)
+	}
+	return field
+}
+
+func (f IntField[W]) Get(word W) int {
+	return int(int64(uint64(word)>>f.shift&f.mask) + f.min)
+}
+
+// Set leaves the word untouched when the value is out of range
+func (f IntField[W]) Set(word *W, value int) error {
+	if int64(value) < f.min || int64(value) > f.max {
+		return fmt.Errorf("%w: %s = %d, allowed [%d, %d]", ErrOutOfRange, f.name, value, f.min, f.max)
+	}
+	f.store(word, int64(value))
+	return nil
+}
+
+// SetClamped stores the bound of the range nearest to an out of range value
+func (f IntField[W]) SetClamped(word *W, value int) {
+	f.store(word, min(max(int64(value), f.min), f.max))
+}
+
+func (f IntField[W]) store(word *W, value int64) {
+	*word = *word&^W(f.mask<<f.shift) | W(uint64(value-f.min)<<f.shift)
+}
+
+// BoolField reads and writes one flag of a word
+type BoolField[W Word] struct {
+	shift uint
+}
+
+// Bool makes an accessor of the flag the selector points to,
+// the layout must be compiled from T and fit in W
+func Bool[W Word, T any](layout *Layout, selector func(*T) *bool) (BoolField[W], error) {
+	field, err := lookup[W](layout, selector)
+	if err != nil {
+		return BoolField[W]{}, err
+	}
+	return BoolField[W]{shift: uint(field.Shift)}, nil
+}
+
+func MustBool[W Word, T any](layout *Layout, selector func(*T) *bool) BoolField[W] {
+	field, err := Bool[W](layout, selector)
+	if err != nil {
+		panic(err)
+	}
+	return field
+}
+
+func (f BoolField[W]) Get(word W) bool {
+	return word>>f.shift&1 == 1
+}
+
+func (f BoolField[W]) Set(word *W, value bool) {
+	if value {
+		*word |= 1 << f.shift
+	} else {
+		*word &^= 1 << f.shift
+	}
+}
+
+// lookup finds the field by its offset, the selector is called once on a zero value
+func lookup[W Word, T, V any](layout *Layout, selector func(*T) *V) (Field, error) {
+	if bits := reflect.TypeFor[W]().Bits(); layout.width > bits {
+		return Field{}, fmt.Errorf("%w: %s needs %d bits, the word has %d", ErrLayout, layout.typ.Name(), layout.width, bits)
+	}
+	if typ := reflect.TypeFor[T](); typ != layout.typ {
+		return Field{}, fmt.Errorf("%w: %s is compiled from %s, not %s", ErrLayout, layout.typ.Name(), layout.typ, typ)
+	}
+
+	var value T
+	offset := uintptr(unsafe.Pointer(selector(&value))) - uintptr(unsafe.Pointer(&value))
+	for _, field := range layout.fields {
+		structField := layout.typ.Field(field.index)
+		if !field.Reserved && structField.Offset == offset && structField.Type == reflect.TypeFor[V]() {
+			return field, nil
+		}
+	}
+	return Field{}, fmt.Errorf("%w: the selector does not point to a field of %s", ErrLayout, layout.typ.Name())
+}
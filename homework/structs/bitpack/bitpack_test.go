@@ -0,0 +1,189 @@
+package bitpack
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// go test -v .
+
+type sensorReading struct {
+	Temperature int16  `bits:"7" range:"-40,80"`
+	Humidity    uint8  `bits:"7" range:"0,100"`
+	Online      bool   `bits:"1"`
+	_           uint8  `bits:"3"`
+	Battery     uint16 `bits:"12"`
+}
+
+func TestLayout(t *testing.T) {
+	layout := MustCompile[sensorReading]()
+	assert.Equal(t, 30, layout.Width())
+
+	fields := layout.Fields()
+	require.Len(t, fields, 5)
+	assert.Equal(t, Field{Name: "Temperature", Shift: 23, Bits: 7, Min: -40, Max: 80, Kind: reflect.Int16}, fields[0])
+	assert.Equal(t, 12, fields[3].Shift)
+	assert.True(t, fields[3].Reserved)
+
+	_, found := layout.Field("_")
+	assert.False(t, found)
+	battery, found := layout.Field("Battery")
+	require.True(t, found)
+	assert.Equal(t, int64(4095), battery.Max)
+
+	expected := "sensorReading: 30 bits\n" +
+		"  29-23  Temperature  7   [-40, 80]\n" +
+		"  22-16  Humidity     7   [0, 100]\n" +
+		"  15     Online       1   bool\n" +
+		"  14-12  _            3   reserved\n" +
+		"  11-0   Battery      12  [0, 4095]\n"
+	assert.Equal(t, expected, layout.Report())
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := map[string]reflect.Type{
+		"not a struct": reflect.TypeFor[int](),
+		"no tag": reflect.TypeFor[struct {
+			Value uint8
+		}](),
+		"bad width": reflect.TypeFor[struct {
+			Value uint8 `bits:"0"`
+		}](),
+		"unexported": reflect.TypeFor[struct {
+			value uint8 `bits:"4"`
+		}](),
+		"wide bool": reflect.TypeFor[struct {
+			Flag bool `bits:"2"`
+		}](),
+		"unsupported type": reflect.TypeFor[struct {
+			Value float32 `bits:"8"`
+		}](),
+		"range too wide": reflect.TypeFor[struct {
+			Value uint16 `bits:"4" range:"0,16"`
+		}](),
+		"empty range": reflect.TypeFor[struct {
+			Value uint8 `bits:"4" range:"5,1"`
+		}](),
+		"malformed range": reflect.TypeFor[struct {
+			Value uint8 `bits:"4" range:"5"`
+		}](),
+		"range outside type": reflect.TypeFor[struct {
+			Value uint8 `bits:"4" range:"-1,10"`
+		}](),
+		"too many bits": reflect.TypeFor[struct {
+			High uint64 `bits:"40"`
+			Low  uint64 `bits:"40"`
+		}](),
+	}
+
+	for name, typ := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Compile(typ)
+			assert.ErrorIs(t, err, ErrLayout)
+		})
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	layout := MustCompile[sensorReading]()
+	temperature := MustInt[uint32](layout, func(r *sensorReading) *int16 { return &r.Temperature })
+	humidity := MustInt[uint32](layout, func(r *sensorReading) *uint8 { return &r.Humidity })
+	battery := MustInt[uint32](layout, func(r *sensorReading) *uint16 { return &r.Battery })
+	online := MustBool[uint32](layout, func(r *sensorReading) *bool { return &r.Online })
+
+	var word uint32
+	require.NoError(t, temperature.Set(&word, -40))
+	require.NoError(t, humidity.Set(&word, 100))
+	require.NoError(t, battery.Set(&word, 4095))
+	online.Set(&word, true)
+	assert.Equal(t, -40, temperature.Get(word))
+	assert.Equal(t, 100, humidity.Get(word))
+	assert.Equal(t, 4095, battery.Get(word))
+	assert.True(t, online.Get(word))
+
+	before := word
+	assert.ErrorIs(t, temperature.Set(&word, 81), ErrOutOfRange)
+	assert.ErrorIs(t, humidity.Set(&word, 101), ErrOutOfRange)
+	assert.ErrorIs(t, battery.Set(&word, -1), ErrOutOfRange)
+	assert.Equal(t, before, word) // rejected values leave the word untouched
+
+	humidity.SetClamped(&word, 250)
+	temperature.SetClamped(&word, -100)
+	assert.Equal(t, 100, humidity.Get(word))
+	assert.Equal(t, -40, temperature.Get(word))
+	assert.Equal(t, 4095, battery.Get(word))
+
+	require.NoError(t, temperature.Set(&word, 80))
+	online.Set(&word, false)
+	assert.Equal(t, 80, temperature.Get(word))
+	assert.False(t, online.Get(word))
+	assert.Equal(t, 100, humidity.Get(word))
+	assert.NoError(t, layout.Validate(uint64(word)))
+
+	_, err := Int[uint16](layout, func(r *sensorReading) *uint16 { return &r.Battery })
+	assert.ErrorIs(t, err, ErrLayout) // 30 bits do not fit in uint16
+	_, err = Bool[uint32](layout, func(r *struct{ Online bool }) *bool { return &r.Online })
+	assert.ErrorIs(t, err, ErrLayout)
+	var elsewhere uint8
+	_, err = Int[uint32](layout, func(r *sensorReading) *uint8 { return &elsewhere })
+	assert.ErrorIs(t, err, ErrLayout)
+}
+
+func TestValidate(t *testing.T) {
+	layout := MustCompile[sensorReading]()
+	humidity := MustInt[uint64](layout, func(r *sensorReading) *uint8 { return &r.Humidity })
+
+	var word uint64
+	require.NoError(t, humidity.Set(&word, 50))
+	assert.NoError(t, layout.Validate(word))
+
+	assert.ErrorIs(t, layout.Validate(word|1<<13), ErrReservedBits)
+	assert.ErrorIs(t, layout.Validate(word|1<<40), ErrReservedBits)
+	assert.ErrorIs(t, layout.Validate(word|127<<16), ErrOutOfRange)
+	assert.ErrorIs(t, layout.Validate(word|127<<23), ErrOutOfRange) // 87 degrees
+}
+
+func TestPackUnpack(t *testing.T) {
+	layout := MustCompile[sensorReading]()
+	reading := sensorReading{Temperature: -5, Humidity: 64, Online: true, Battery: 3300}
+
+	word, err := layout.Pack(reading)
+	require.NoError(t, err)
+	assert.Equal(t, -5, MustInt[uint64](layout, func(r *sensorReading) *int16 { return &r.Temperature }).Get(word))
+	assert.Equal(t, 3300, MustInt[uint64](layout, func(r *sensorReading) *uint16 { return &r.Battery }).Get(word))
+
+	var unpacked sensorReading
+	require.NoError(t, layout.Unpack(word, &unpacked))
+	assert.Equal(t, reading, unpacked)
+
+	reading.Humidity = 101
+	_, err = layout.Pack(&reading)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+
+	_, err = layout.Pack(struct{ Humidity uint8 }{})
+	assert.ErrorIs(t, err, ErrLayout)
+	assert.ErrorIs(t, layout.Unpack(word, unpacked), ErrLayout)
+	assert.ErrorIs(t, layout.Unpack(word|1<<12, &unpacked), ErrReservedBits)
+}
+
+func TestFullWord(t *testing.T) {
+	type wide struct {
+		Value uint64 `bits:"63"`
+		Flag  bool   `bits:"1"`
+	}
+
+	layout := MustCompile[wide]()
+	value := MustInt[uint64](layout, func(w *wide) *uint64 { return &w.Value })
+	flag := MustBool[uint64](layout, func(w *wide) *bool { return &w.Flag })
+
+	var word uint64
+	require.NoError(t, value.Set(&word, math.MaxInt64))
+	flag.Set(&word, true)
+	assert.Equal(t, uint64(math.MaxUint64), word)
+	assert.Equal(t, math.MaxInt64, value.Get(word))
+	assert.NoError(t, layout.Validate(word))
+}
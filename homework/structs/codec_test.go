@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang_course/homework/structs/bitpack"
+)
+
+// go test -v homework_test.go codec_test.go
+// go test -fuzz=FuzzUnmarshalGamePerson homework_test.go codec_test.go
+
+// The wire layout does not depend on the platform: a version byte
+// followed by the fields in declaration order, integers in little endian
+//
+//	0   version
+//	1   name        42 bytes
+//	43  attributes1 uint16
+//	45  attributes2 uint32
+//	49  gold        uint32
+//	53  x, y, z     int32 each
+const (
+	personWireVersion = 1
+	personWireSize    = 65
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("game person: unsupported wire version")
+	ErrMalformedPerson    = errors.New("game person: malformed data")
+)
+
+var (
+	_ encoding.BinaryMarshaler   = (*GamePerson)(nil)
+	_ encoding.BinaryUnmarshaler = (*GamePerson)(nil)
+)
+
+// MarshalBinary refuses a person UnmarshalBinary would reject
+func (p *GamePerson) MarshalBinary() ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p.appendBinary(make([]byte, 0, personWireSize)), nil
+}
+
+func (p *GamePerson) appendBinary(data []byte) []byte {
+	data = append(data, personWireVersion)
+	data = append(data, p.name[:]...)
+	data = binary.LittleEndian.AppendUint16(data, p.attributes1)
+	data = binary.LittleEndian.AppendUint32(data, p.attributes2)
+	data = binary.LittleEndian.AppendUint32(data, p.gold)
+	for _, coordinate := range [...]int32{p.x, p.y, p.z} {
+		data = binary.LittleEndian.AppendUint32(data, uint32(coordinate))
+	}
+	return data
+}
+
+// UnmarshalBinary accepts only what MarshalBinary can produce,
+// the person is left untouched when the data is rejected
+func (p *GamePerson) UnmarshalBinary(data []byte) error {
+	if len(data) != personWireSize {
+		return fmt.Errorf("%w: %d bytes instead of %d", ErrMalformedPerson, len(data), personWireSize)
+	}
+	if data[0] != personWireVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, data[0])
+	}
+
+	var person GamePerson
+	copy(person.name[:], data[1:43])
+	person.attributes1 = binary.LittleEndian.Uint16(data[43:])
+	person.attributes2 = binary.LittleEndian.Uint32(data[45:])
+	person.gold = binary.LittleEndian.Uint32(data[49:])
+	person.x = int32(binary.LittleEndian.Uint32(data[53:]))
+	person.y = int32(binary.LittleEndian.Uint32(data[57:]))
+	person.z = int32(binary.LittleEndian.Uint32(data[61:]))
+
+	if err := person.validate(); err != nil {
+		return err
+	}
+	*p = person
+	return nil
+}
+
+func (p *GamePerson) validate() error {
+	if err := primaryLayout.Validate(uint64(p.attributes1)); err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformedPerson, err)
+	}
+	if err := secondaryLayout.Validate(uint64(p.attributes2)); err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformedPerson, err)
+	}
+	return nil
+}
+
+// EncodePersons writes the persons one record after another, nothing
+// is written when one of them is invalid
+func EncodePersons(w io.Writer, persons []GamePerson) error {
+	for idx := range persons {
+		if err := persons[idx].validate(); err != nil {
+			return fmt.Errorf("record %d: %w", idx, err)
+		}
+	}
+
+	buffered := bufio.NewWriter(w)
+	record := make([]byte, 0, personWireSize)
+	for idx := range persons {
+		if _, err := buffered.Write(persons[idx].appendBinary(record[:0])); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+// DecodePersons passes records to handle one by one until the end of r
+// or until handle fails, a record cut in the middle is reported as io.ErrUnexpectedEOF
+func DecodePersons(r io.Reader, handle func(person GamePerson) error) error {
+	buffered := bufio.NewReader(r)
+	record := make([]byte, personWireSize)
+	for index := 0; ; index++ {
+		if _, err := io.ReadFull(buffered, record); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var person GamePerson
+		if err := person.UnmarshalBinary(record); err != nil {
+			return fmt.Errorf("record %d: %w", index, err)
+		}
+		if err := handle(person); err != nil {
+			return err
+		}
+	}
+}
+
+// collectPersons decodes the whole stream, it keeps what was decoded before a failure
+func collectPersons(r io.Reader) ([]GamePerson, error) {
+	var persons []GamePerson
+	err := DecodePersons(r, func(person GamePerson) error {
+		persons = append(persons, person)
+		return nil
+	})
+	return persons, err
+}
+
+func samplePerson(t testing.TB) GamePerson {
+	t.Helper()
+	person, err := NewGamePerson(
+		WithName("Гимли"),
+		WithCoordinates(math.MinInt32, -1, math.MaxInt32),
+		WithGold(math.MaxUint32),
+		WithMana(1000),
+		WithHealth(7),
+		WithRespect(15),
+		WithLevel(1),
+		WithGun(),
+		WithFamily(),
+		WithType(WarriorGamePersonType),
+	)
+	require.NoError(t, err)
+	return person
+}
+
+func TestGamePersonBinary(t *testing.T) {
+	person := samplePerson(t)
+	data, err := person.MarshalBinary()
+	require.NoError(t, err)
+	require.Len(t, data, personWireSize)
+
+	// the layout is fixed, so it is checked byte by byte
+	assert.Equal(t, byte(personWireVersion), data[0])
+	assert.Equal(t, []byte("Гимли"), data[1:1+len("Гимли")])
+	assert.Equal(t, []byte{0x01, 0xF0}, data[43:45])
+	assert.Equal(t, []byte{0xFF, 0xFF, 0xFF, 0xFF}, data[49:53])
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x80}, data[53:57])
+
+	var decoded GamePerson
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, person, decoded)
+
+	data[0] = 2
+	assert.ErrorIs(t, decoded.UnmarshalBinary(data), ErrUnsupportedVersion)
+	assert.ErrorIs(t, decoded.UnmarshalBinary(data[:10]), ErrMalformedPerson)
+
+	data[0] = personWireVersion
+	data[45] |= 0x01
+	assert.ErrorIs(t, decoded.UnmarshalBinary(data), ErrMalformedPerson)
+	assert.ErrorIs(t, decoded.UnmarshalBinary(data), bitpack.ErrReservedBits)
+	assert.Equal(t, person, decoded) // rejected data leaves the person as it was
+}
+
+func TestEncodeDecodePersons(t *testing.T) {
+	bob, err := NewGamePerson(WithName("Bob"), WithType(BlacksmithGamePersonType))
+	require.NoError(t, err)
+	persons := []GamePerson{samplePerson(t), bob, {}}
+
+	var stream bytes.Buffer
+	require.NoError(t, EncodePersons(&stream, persons))
+	assert.Equal(t, len(persons)*personWireSize, stream.Len())
+
+	encoded := bytes.Clone(stream.Bytes())
+	decoded, err := collectPersons(&stream)
+	require.NoError(t, err)
+	assert.Equal(t, persons, decoded)
+
+	decoded, err = collectPersons(bytes.NewReader(encoded[:personWireSize+10]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Len(t, decoded, 1)
+
+	encoded[personWireSize] = 0
+	_, err = collectPersons(bytes.NewReader(encoded))
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+	assert.ErrorContains(t, err, "record 1")
+
+	decoded, err = collectPersons(bytes.NewReader(nil))
+	assert.NoError(t, err)
+	assert.Empty(t, decoded)
+
+	// handle stops the stream
+	errStop := errors.New("stop")
+	var handled int
+	err = DecodePersons(bytes.NewReader(encoded), func(GamePerson) error {
+		handled++
+		return errStop
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, 1, handled)
+}
+
+func TestEncodeInvalidPerson(t *testing.T) {
+	invalid := samplePerson(t)
+	invalid.attributes2 |= 1 // a reserved bit
+
+	_, err := invalid.MarshalBinary()
+	assert.ErrorIs(t, err, ErrMalformedPerson)
+
+	var stream bytes.Buffer
+	err = EncodePersons(&stream, []GamePerson{samplePerson(t), invalid})
+	assert.ErrorIs(t, err, bitpack.ErrReservedBits)
+	assert.ErrorContains(t, err, "record 1")
+	assert.Zero(t, stream.Len())
+}
+
+func FuzzUnmarshalGamePerson(f *testing.F) {
+	person := samplePerson(f)
+	valid, _ := person.MarshalBinary()
+	f.Add(valid)
+	f.Add(valid[:personWireSize-1])
+	f.Add(append(bytes.Clone(valid), 0))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var person GamePerson
+		if err := person.UnmarshalBinary(data); err != nil {
+			return
+		}
+
+		// everything accepted must be encoded back to the same bytes
+		encoded, err := person.MarshalBinary()
+		require.NoError(t, err)
+		require.Equal(t, data, encoded)
+	})
+}
+
+func FuzzDecodePersons(f *testing.F) {
+	var stream bytes.Buffer
+	_ = EncodePersons(&stream, []GamePerson{samplePerson(f), {}})
+	f.Add(stream.Bytes())
+	f.Add(stream.Bytes()[:personWireSize+1])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		persons, err := collectPersons(bytes.NewReader(data))
+		if err == nil {
+			require.Equal(t, 0, len(data)%personWireSize)
+		}
+
+		// the decoded prefix must survive a round trip
+		var encoded bytes.Buffer
+		require.NoError(t, EncodePersons(&encoded, persons))
+		require.True(t, bytes.Equal(data[:len(persons)*personWireSize], encoded.Bytes()))
+	})
+}
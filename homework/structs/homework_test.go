@@ -7,97 +7,133 @@ import (
 	"unsafe"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang_course/homework/structs/bitpack"
+)
+
+// primaryAttributes and secondaryAttributes describe the bits of
+// attributes1 and attributes2, the highest bits come first
+type primaryAttributes struct {
+	Respect    uint8 `bits:"4"`
+	Strength   uint8 `bits:"4"`
+	Experience uint8 `bits:"4"`
+	Level      uint8 `bits:"4"`
+}
+
+type secondaryAttributes struct {
+	Mana   uint16 `bits:"10" range:"0,1000"`
+	Health uint16 `bits:"10" range:"0,1000"`
+	House  bool   `bits:"1"`
+	Gun    bool   `bits:"1"`
+	Family bool   `bits:"1"`
+	Type   uint8  `bits:"2" range:"0,2"`
+	_      uint8  `bits:"7"`
+}
+
+var (
+	primaryLayout   = bitpack.MustCompile[primaryAttributes]()
+	secondaryLayout = bitpack.MustCompile[secondaryAttributes]()
+
+	respectField    = bitpack.MustInt[uint16](primaryLayout, func(a *primaryAttributes) *uint8 { return &a.Respect })
+	strengthField   = bitpack.MustInt[uint16](primaryLayout, func(a *primaryAttributes) *uint8 { return &a.Strength })
+	experienceField = bitpack.MustInt[uint16](primaryLayout, func(a *primaryAttributes) *uint8 { return &a.Experience })
+	levelField      = bitpack.MustInt[uint16](primaryLayout, func(a *primaryAttributes) *uint8 { return &a.Level })
+
+	manaField   = bitpack.MustInt[uint32](secondaryLayout, func(a *secondaryAttributes) *uint16 { return &a.Mana })
+	healthField = bitpack.MustInt[uint32](secondaryLayout, func(a *secondaryAttributes) *uint16 { return &a.Health })
+	houseField  = bitpack.MustBool[uint32](secondaryLayout, func(a *secondaryAttributes) *bool { return &a.House })
+	gunField    = bitpack.MustBool[uint32](secondaryLayout, func(a *secondaryAttributes) *bool { return &a.Gun })
+	familyField = bitpack.MustBool[uint32](secondaryLayout, func(a *secondaryAttributes) *bool { return &a.Family })
+	typeField   = bitpack.MustInt[uint32](secondaryLayout, func(a *secondaryAttributes) *uint8 { return &a.Type })
 )
 
-type Option func(*GamePerson)
+// Option reports a value that does not fit its field instead of storing it
+type Option func(*GamePerson) error
 
-func WithName(name string) func(*GamePerson) {
-	return func(person *GamePerson) {
+func WithName(name string) Option {
+	return func(person *GamePerson) error {
 		copy(person.name[:], name)
+		return nil
 	}
 }
 
-func WithCoordinates(x, y, z int) func(*GamePerson) {
-	return func(person *GamePerson) {
+func WithCoordinates(x, y, z int) Option {
+	return func(person *GamePerson) error {
 		person.x = int32(x)
 		person.y = int32(y)
 		person.z = int32(z)
+		return nil
 	}
 }
 
-func WithGold(gold int) func(*GamePerson) {
-	return func(person *GamePerson) {
+func WithGold(gold int) Option {
+	return func(person *GamePerson) error {
 		person.gold = uint32(gold)
+		return nil
 	}
 }
 
-func WithMana(mana int) func(*GamePerson) {
-	return func(person *GamePerson) {
-		mask := uint32(0x3FF << 22)
-		person.attributes2 = (person.attributes2 &^ mask) | (uint32(mana) << 22)
+func WithMana(mana int) Option {
+	return func(person *GamePerson) error {
+		return manaField.Set(&person.attributes2, mana)
 	}
 }
 
-func WithHealth(health int) func(*GamePerson) {
-	return func(person *GamePerson) {
-		mask := uint32(0x3FF << 12)
-		person.attributes2 = (person.attributes2 &^ mask) | (uint32(health) << 12)
+func WithHealth(health int) Option {
+	return func(person *GamePerson) error {
+		return healthField.Set(&person.attributes2, health)
 	}
 }
 
-func WithRespect(respect int) func(*GamePerson) {
-	return func(person *GamePerson) {
-		mask := uint16(0xF << 12)
-		person.attributes1 = (person.attributes1 &^ mask) | (uint16(respect) << 12)
+func WithRespect(respect int) Option {
+	return func(person *GamePerson) error {
+		return respectField.Set(&person.attributes1, respect)
 	}
 }
 
-func WithStrength(strength int) func(*GamePerson) {
-	return func(person *GamePerson) {
-		mask := uint16(0xF << 8)
-		person.attributes1 = (person.attributes1 &^ mask) | (uint16(strength) << 8)
+func WithStrength(strength int) Option {
+	return func(person *GamePerson) error {
+		return strengthField.Set(&person.attributes1, strength)
 	}
 }
 
-func WithExperience(experience int) func(*GamePerson) {
-	return func(person *GamePerson) {
-		mask := uint16(0xF << 4)
-		person.attributes1 = (person.attributes1 &^ mask) | (uint16(experience) << 4)
+func WithExperience(experience int) Option {
+	return func(person *GamePerson) error {
+		return experienceField.Set(&person.attributes1, experience)
 	}
 }
 
-func WithLevel(level int) func(*GamePerson) {
-	return func(person *GamePerson) {
-		mask := uint16(0xF << 0)
-		person.attributes1 = (person.attributes1 &^ mask) | (uint16(level) << 0)
+func WithLevel(level int) Option {
+	return func(person *GamePerson) error {
+		return levelField.Set(&person.attributes1, level)
 	}
 }
 
-func WithHouse() func(*GamePerson) {
-	return func(person *GamePerson) {
-		mask := uint32(0b1 << 11)
-		person.attributes2 = (person.attributes2 &^ mask) | (1 << 11)
+func WithHouse() Option {
+	return func(person *GamePerson) error {
+		houseField.Set(&person.attributes2, true)
+		return nil
 	}
 }
 
-func WithGun() func(*GamePerson) {
-	return func(person *GamePerson) {
-		mask := uint32(0b1 << 10)
-		person.attributes2 = (person.attributes2 &^ mask) | (1 << 10)
+func WithGun() Option {
+	return func(person *GamePerson) error {
+		gunField.Set(&person.attributes2, true)
+		return nil
 	}
 }
 
-func WithFamily() func(*GamePerson) {
-	return func(person *GamePerson) {
-		mask := uint32(0b1 << 9)
-		person.attributes2 = (person.attributes2 &^ mask) | (1 << 9)
+func WithFamily() Option {
+	return func(person *GamePerson) error {
+		familyField.Set(&person.attributes2, true)
+		return nil
 	}
 }
 
-func WithType(personType int) func(*GamePerson) {
-	return func(person *GamePerson) {
-		mask := uint32(0b11 << 7)
-		person.attributes2 = (person.attributes2 &^ mask) | (uint32(personType) << 7)
+func WithType(personType int) Option {
+	return func(person *GamePerson) error {
+		return typeField.Set(&person.attributes2, personType)
 	}
 }
 
@@ -110,21 +146,20 @@ const (
 type GamePerson struct {
 	name        [42]byte // 42 bytes total, 42 characters
 	attributes1 uint16   // 2 bytes total, 4 bits for each: respect, strength, experience, level (in this order L->R)
-	// mana, health - 10 bits each ([0,1000])
-	// home, weapon, family - 1 bit each (boolean)
-	// player type - 2 bits ([0,2]) - all in this order L->R
-	// total 25 bits -> ceil total 32 bits -> ceil total 4 bytes
-	attributes2 uint32
-	gold        uint32 // 4 bytes total
-	x, y, z     int32  // 12 bytes total
+	attributes2 uint32   // 4 bytes total, the layout is secondaryAttributes
+	gold        uint32   // 4 bytes total
+	x, y, z     int32    // 12 bytes total
 }
 
-func NewGamePerson(options ...Option) GamePerson {
+// NewGamePerson stops at the first value that does not fit its field
+func NewGamePerson(options ...Option) (GamePerson, error) {
 	entity := GamePerson{}
 	for idx := range options {
-		options[idx](&entity)
+		if err := options[idx](&entity); err != nil {
+			return GamePerson{}, err
+		}
 	}
-	return entity
+	return entity, nil
 }
 
 func (p *GamePerson) Name() string {
@@ -148,43 +183,43 @@ func (p *GamePerson) Gold() int {
 }
 
 func (p *GamePerson) Mana() int {
-	return int(p.attributes2 >> 22 & 0x3FF)
+	return manaField.Get(p.attributes2)
 }
 
 func (p *GamePerson) Health() int {
-	return int(p.attributes2 >> 12 & 0x3FF)
+	return healthField.Get(p.attributes2)
 }
 
 func (p *GamePerson) Respect() int {
-	return int(p.attributes1 >> 12 & 0xF)
+	return respectField.Get(p.attributes1)
 }
 
 func (p *GamePerson) Strength() int {
-	return int(p.attributes1 >> 8 & 0xF)
+	return strengthField.Get(p.attributes1)
 }
 
 func (p *GamePerson) Experience() int {
-	return int(p.attributes1 >> 4 & 0xF)
+	return experienceField.Get(p.attributes1)
 }
 
 func (p *GamePerson) Level() int {
-	return int(p.attributes1 >> 0 & 0xF)
+	return levelField.Get(p.attributes1)
 }
 
 func (p *GamePerson) HasHouse() bool {
-	return (p.attributes2 >> 11 & 0b1) == 1
+	return houseField.Get(p.attributes2)
 }
 
 func (p *GamePerson) HasGun() bool {
-	return (p.attributes2 >> 10 & 0b1) == 1
+	return gunField.Get(p.attributes2)
 }
 
 func (p *GamePerson) HasFamily() bool {
-	return (p.attributes2 >> 9 & 0b1) == 1
+	return familyField.Get(p.attributes2)
 }
 
 func (p *GamePerson) Type() int {
-	return int(p.attributes2 >> 7 & 0b11)
+	return typeField.Get(p.attributes2)
 }
 
 func TestGamePerson(t *testing.T) {
@@ -216,7 +251,8 @@ func TestGamePerson(t *testing.T) {
 		WithType(personType),
 	}
 
-	person := NewGamePerson(options...)
+	person, err := NewGamePerson(options...)
+	require.NoError(t, err)
 	assert.Equal(t, name, person.Name())
 	assert.Equal(t, x, person.X())
 	assert.Equal(t, y, person.Y())
@@ -235,3 +271,20 @@ func TestGamePerson(t *testing.T) {
 
 	fmt.Println(person.Type())
 }
+
+func TestGamePersonOutOfRange(t *testing.T) {
+	// the layouts keep the bits where the hand-written masks put them
+	word, err := secondaryLayout.Pack(secondaryAttributes{Mana: 1000, Health: 7, Gun: true, Type: WarriorGamePersonType})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1000<<22|7<<12|1<<10|WarriorGamePersonType<<7), word)
+	assert.Equal(t, 32, secondaryLayout.Width())
+	assert.Equal(t, 16, primaryLayout.Width())
+
+	_, err = NewGamePerson(WithName("Bob"), WithMana(2000))
+	assert.ErrorIs(t, err, bitpack.ErrOutOfRange)
+	assert.ErrorContains(t, err, "Mana = 2000, allowed [0, 1000]")
+	for _, option := range []Option{WithRespect(16), WithLevel(-3), WithType(3), WithHealth(-1)} {
+		_, err = NewGamePerson(WithHealth(5), option, WithFamily())
+		assert.ErrorIs(t, err, bitpack.ErrOutOfRange)
+	}
+}